@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** A Reducer folds the record of one stream into the running result for a
+	window. The first record folded into a window is copied into it. */
+type Reducer func(acc *StatRecord, rec *StatRecord)
+
+/** The reducers available for cross-stream aggregation.
+	sum - the total of the streams; the bounds are the sums of the bounds.
+	mean - the mean of all points of all streams, weighted by count.
+	min, max - the lowest or highest of the streams at each point in time. */
+var reducers map[string]Reducer = map[string]Reducer{
+	"sum": func (acc *StatRecord, rec *StatRecord) {
+		acc.Min += rec.Min
+		acc.Mean += rec.Mean
+		acc.Max += rec.Max
+		acc.Count += rec.Count
+	},
+	"mean": mergeRecord,
+	"min": func (acc *StatRecord, rec *StatRecord) {
+		acc.Min = math.Min(acc.Min, rec.Min)
+		acc.Mean = math.Min(acc.Mean, rec.Mean)
+		acc.Max = math.Min(acc.Max, rec.Max)
+		acc.Count += rec.Count
+	},
+	"max": func (acc *StatRecord, rec *StatRecord) {
+		acc.Min = math.Max(acc.Min, rec.Min)
+		acc.Mean = math.Max(acc.Mean, rec.Mean)
+		acc.Max = math.Max(acc.Max, rec.Max)
+		acc.Count += rec.Count
+	},
+}
+
+/** The body of a request to /aggregate. The streams to combine are given by
+	UUIDS, by a PATH pattern in which '%' matches any sequence of characters,
+	or by both. START, END and PW have the same meaning as in /data. */
+type aggregateRequest struct {
+	Reducer string `json:"reducer"`
+	Uuids []string `json:"uuids"`
+	Path string `json:"path"`
+	Start int64 `json:"start"`
+	End int64 `json:"end"`
+	Pw uint8 `json:"pw"`
+}
+
+/** Combines the statistical records of several streams into one stream with
+	the specified reducer. The streams are queried in parallel. A window is
+	present in the result if any stream has data in it; streams without data
+	in a window are left out of it. */
+func (rt *Router) QueryAggregate(uuids []uuid.UUID, startTime int64, endTime int64, pw uint8, reducerName string) ([]StatRecord, error) {
+	reduce, ok := reducers[reducerName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown reducer %v", reducerName)
+	}
+	
+	var results [][]StatRecord = make([][]StatRecord, len(uuids))
+	var errs []error = make([]error, len(uuids))
+	var wg sync.WaitGroup
+	for i, id := range uuids {
+		rt.usage.Count(id.String())
+		wg.Add(1)
+		go func (i int, id uuid.UUID) {
+			defer wg.Done()
+			results[i], errs[i] = rt.QueryStatisticalValues(id, startTime, endTime, pw)
+		}(i, id)
+	}
+	wg.Wait()
+	
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("Could not query %v: %v", uuids[i].String(), err)
+		}
+	}
+	
+	var windows map[int64]*StatRecord = make(map[int64]*StatRecord)
+	for i := range results {
+		for j := range results[i] {
+			var rec *StatRecord = &results[i][j]
+			acc, ok := windows[rec.Time]
+			if !ok {
+				var copied StatRecord = *rec
+				windows[rec.Time] = &copied
+				continue
+			}
+			reduce(acc, rec)
+		}
+	}
+	
+	var combined []StatRecord = make([]StatRecord, 0, len(windows))
+	for _, acc := range windows {
+		combined = append(combined, *acc)
+	}
+	sort.Slice(combined, func (i int, j int) bool {
+		return combined[i].Time < combined[j].Time
+	})
+	return combined, nil
+}
+
+/** Returns the UUIDs of the streams visible to the principal whose Path
+	matches the pattern, in which '%' matches any sequence of characters. */
+func (rt *Router) lookupPathPattern(pattern string, p *Principal) ([]uuid.UUID, error) {
+	if strings.ContainsRune(pattern, '"') {
+		return nil, fmt.Errorf("Path pattern may not contain '\"'")
+	}
+	var query string = fmt.Sprintf("select * where Path like \"%v\"", pattern)
+	resp, err := http.Post(metadataURL(rt.mdServer, p), "text", strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	
+	var docs []struct {
+		Uuid string `json:"uuid"`
+	}
+	err = json.Unmarshal(body, &docs)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse metadata response: %v", err)
+	}
+	
+	var uuids []uuid.UUID = make([]uuid.UUID, 0, len(docs))
+	for _, doc := range docs {
+		if parsed := uuid.Parse(doc.Uuid); parsed != nil {
+			uuids = append(uuids, parsed)
+		}
+	}
+	return uuids, nil
+}
+
+/** Serves POST requests to /aggregate. The response has the same format as a
+	response from /data. */
+func (rt *Router) ServeAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("You must send a POST request to get data."))
+		return
+	}
+	
+	payload, ok := rt.limits.ReadBody(w, r)
+	if !ok {
+		return
+	}
+	
+	var req aggregateRequest
+	err := json.Unmarshal(payload, &req)
+	if err == nil {
+		if _, ok := reducers[req.Reducer]; !ok {
+			err = fmt.Errorf("Unknown reducer %q", req.Reducer)
+		} else if len(req.Uuids) == 0 && req.Path == "" {
+			err = fmt.Errorf("Either \"uuids\" or \"path\" is required")
+		} else if req.Pw > 62 || req.Start < QUASAR_LOW || req.End > QUASAR_HIGH || req.Start >= req.End {
+			err = fmt.Errorf("Invalid range [%v, %v] or point width %v", req.Start, req.End, req.Pw)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid request: %v", err)))
+		return
+	}
+	
+	var uuids []uuid.UUID = make([]uuid.UUID, 0, len(req.Uuids))
+	var seen map[string]bool = make(map[string]bool)
+	for _, uuidStr := range req.Uuids {
+		var parsed uuid.UUID = uuid.Parse(uuidStr)
+		if parsed == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Received invalid UUID %v", uuidStr)))
+			return
+		}
+		if !seen[parsed.String()] {
+			seen[parsed.String()] = true
+			uuids = append(uuids, parsed)
+		}
+	}
+	if req.Path != "" {
+		matched, err := rt.lookupPathPattern(req.Path, rt.auth.Authenticate(r))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(fmt.Sprintf("Could not look up streams matching %v: %v", req.Path, err)))
+			return
+		}
+		for _, parsed := range matched {
+			if !seen[parsed.String()] {
+				seen[parsed.String()] = true
+				uuids = append(uuids, parsed)
+			}
+		}
+	}
+	
+	var pw uint8 = req.Pw
+	var startTime int64 = (req.Start >> pw) << pw
+	var endTime int64 = ((req.End >> pw) + 1) << pw
+	noteAccess(r, uuids, startTime, endTime)
+	if !rt.limits.Admit(w, r, estimateCost(len(uuids), len(uuids), startTime, endTime, int64(1) << pw)) {
+		return
+	}
+	
+	records, err := rt.QueryAggregate(uuids, startTime, endTime, pw, req.Reducer)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	
+	writeStatRecords(records, RespWrapper{w})
+}
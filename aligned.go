@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	
+	quasar "github.com/SoftwareDefinedBuildings/webgl-plotter/quasar"
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** The largest table, in rows, that /aligned will return. */
+const MAX_ALIGNED_ROWS int64 = 1 << 20
+
+/** The largest request body, in bytes, that we accept unless max_body_size
+	says otherwise. */
+const MAX_QUERY_REQUEST_SIZE int64 = 1 << 20
+
+/** The body of a request to /aligned. Exactly one of PW and STEP must be
+	given: PW selects windows of width 2^PW nanoseconds aligned as in /data,
+	while STEP selects windows of exactly STEP nanoseconds beginning at START,
+	served by a windowed query. */
+type alignedRequest struct {
+	Uuids []string `json:"uuids"`
+	Start int64 `json:"start"`
+	End int64 `json:"end"`
+	Pw *uint8 `json:"pw"`
+	Step int64 `json:"step"`
+}
+
+/** Merges the statistics of SRC into DST, weighting the means by count. */
+func mergeRecord(dst *StatRecord, src *StatRecord) {
+	if dst.Count == 0 {
+		var t int64 = dst.Time
+		*dst = *src
+		dst.Time = t
+		return
+	}
+	if src.Count == 0 {
+		return
+	}
+	var total uint64 = dst.Count + src.Count
+	dst.Mean = (dst.Mean * float64(dst.Count) + src.Mean * float64(src.Count)) / float64(total)
+	dst.Min = math.Min(dst.Min, src.Min)
+	dst.Max = math.Max(dst.Max, src.Max)
+	dst.Count = total
+}
+
+/** Returns the largest point width whose windows are no wider than STEP. */
+func pointWidthForStep(step int64) uint8 {
+	var pw uint8 = 0
+	for pw < 62 && (int64(1) << (pw + 1)) <= step {
+		pw++
+	}
+	return pw
+}
+
+/** Obtains statistical records for several streams on a common time grid.
+	The grid has a row every STEP nanoseconds from START until END; COLUMNS[i]
+	holds the record of stream i for each row, or nil where the stream has no
+	data. The streams are queried in parallel. */
+func (rt *Router) QueryAligned(uuids []uuid.UUID, start int64, end int64, step int64) (times []int64, columns [][]*StatRecord, err error) {
+	// Rounds up without adding STEP, which could overflow
+	var numRows int64 = (end - start - 1) / step + 1
+	if numRows > MAX_ALIGNED_ROWS {
+		return nil, nil, fmt.Errorf("The requested grid has %v rows; at most %v are allowed", numRows, MAX_ALIGNED_ROWS)
+	}
+	
+	var results [][]StatRecord = make([][]StatRecord, len(uuids))
+	var errs []error = make([]error, len(uuids))
+	var wg sync.WaitGroup
+	for i, id := range uuids {
+		rt.usage.Count(id.String())
+		wg.Add(1)
+		go func (i int, id uuid.UUID) {
+			defer wg.Done()
+			results[i], errs[i] = rt.QueryWidth(id, start, end, step)
+		}(i, id)
+	}
+	wg.Wait()
+	
+	for i, err := range errs {
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not query %v: %v", uuids[i].String(), err)
+		}
+	}
+	
+	times = make([]int64, numRows)
+	var row int64
+	for row = 0; row < numRows; row++ {
+		times[row] = start + row * step
+	}
+	
+	columns = make([][]*StatRecord, len(uuids))
+	for i := range results {
+		columns[i] = make([]*StatRecord, numRows)
+		for j := range results[i] {
+			row = (results[i][j].Time - start) / step
+			if row >= 0 && row < numRows {
+				columns[i][row] = &results[i][j]
+			}
+		}
+	}
+	
+	return
+}
+
+/** Serves POST requests to /aligned. The response is a JSON object whose
+	"columns" are "time" followed by the requested UUIDs, and whose "rows" each
+	hold a time, as [millis, nanos], followed by [min, mean, max, count] for
+	each stream, or null where the stream has no data. */
+func (rt *Router) ServeAligned(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("You must send a POST request to get data."))
+		return
+	}
+	
+	payload, ok := rt.limits.ReadBody(w, r)
+	if !ok {
+		return
+	}
+	
+	var req alignedRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid request: %v", err)))
+		return
+	}
+	
+	uuids, start, end, step, err := req.validate()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid request: %v", err)))
+		return
+	}
+	noteAccess(r, uuids, start, end)
+	if !rt.limits.Admit(w, r, estimateCost(len(uuids), len(uuids), start, end, step)) {
+		return
+	}
+	
+	times, columns, err := rt.QueryAligned(uuids, start, end, step)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	
+	var header []string = make([]string, len(uuids) + 1)
+	header[0] = "time"
+	for i, id := range uuids {
+		header[i + 1] = id.String()
+	}
+	
+	var rows [][]interface{} = make([][]interface{}, len(times))
+	for row, t := range times {
+		millis, nanos := quasar.SplitTime(t)
+		rows[row] = make([]interface{}, len(uuids) + 1)
+		rows[row][0] = []interface{}{millis, nanos}
+		for i := range columns {
+			if record := columns[i][row]; record != nil {
+				rows[row][i + 1] = []interface{}{record.Min, record.Mean, record.Max, record.Count}
+			}
+		}
+	}
+	
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"columns": header,
+		"rows": rows,
+	})
+}
+
+/** Checks the request and works out the grid it describes. */
+func (req *alignedRequest) validate() (uuids []uuid.UUID, start int64, end int64, step int64, err error) {
+	if len(req.Uuids) == 0 {
+		err = fmt.Errorf("At least one UUID is required")
+		return
+	}
+	uuids = make([]uuid.UUID, len(req.Uuids))
+	for i, uuidStr := range req.Uuids {
+		uuids[i] = uuid.Parse(uuidStr)
+		if uuids[i] == nil {
+			err = fmt.Errorf("Received invalid UUID %v", uuidStr)
+			return
+		}
+	}
+	
+	if (req.Pw == nil) == (req.Step == 0) {
+		err = fmt.Errorf("Exactly one of \"pw\" and \"step\" is required")
+		return
+	}
+	if req.Start < QUASAR_LOW || req.End > QUASAR_HIGH || req.Start >= req.End {
+		err = fmt.Errorf("Invalid time range [%v, %v]", req.Start, req.End)
+		return
+	}
+	
+	if req.Pw != nil {
+		var pw uint8 = *req.Pw
+		if pw > 62 {
+			err = fmt.Errorf("Invalid point width %v", pw)
+			return
+		}
+		step = int64(1) << pw
+		start = (req.Start >> pw) << pw
+		end = ((req.End >> pw) + 1) << pw // an inclusive endpoint, as in /data
+	} else {
+		if req.Step < 0 {
+			err = fmt.Errorf("\"step\" must be positive")
+			return
+		}
+		step = req.Step
+		start = req.Start
+		end = req.End
+	}
+	return
+}
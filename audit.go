@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+const AUDIT_FILE string = "audit.log"
+
+/** The most entries a query of the audit log returns. */
+const MAX_AUDIT_RESULTS int = 10000
+
+/** The longest metadata query recorded in the audit log, in bytes. */
+const MAX_AUDITED_QUERY int = 1024
+
+/** A record of one request for data. START and END delimit the requested
+	time range, in nanoseconds, if the request had one. STATUS is the HTTP
+	status of the response, or for WebSocket requests the status an HTTP
+	request would have had; ERROR describes a failure that happened after
+	the response had begun. */
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	User string `json:"user,omitempty"`
+	Client string `json:"client"`
+	Endpoint string `json:"endpoint"`
+	Uuids []string `json:"uuids,omitempty"`
+	Start int64 `json:"start,omitempty"`
+	End int64 `json:"end,omitempty"`
+	Query string `json:"query,omitempty"`
+	Status int `json:"status"`
+	Error string `json:"error,omitempty"`
+}
+
+/** An AuditLog appends entries, one JSON document per line, to audit.log in
+	its directory. When the file grows past MAXSIZE bytes it is renamed,
+	with the time of rotation in its name, and a new one is started. If
+	MAXFILES is positive, the oldest rotated files beyond that many are
+	removed. A nil AuditLog records nothing. */
+type AuditLog struct {
+	dir string
+	maxSize int64
+	maxFiles int
+	file *os.File
+	size int64
+	lock *sync.Mutex
+	auth *Authenticator
+}
+
+/** Opens the audit log in DIR, creating the directory if necessary. */
+func OpenAuditLog(dir string, maxSize int64, maxFiles int, auth *Authenticator) (*AuditLog, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	var al *AuditLog = &AuditLog{
+		dir: dir,
+		maxSize: maxSize,
+		maxFiles: maxFiles,
+		lock: &sync.Mutex{},
+		auth: auth,
+	}
+	err = al.open()
+	if err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLog) open() error {
+	file, err := os.OpenFile(filepath.Join(al.dir, AUDIT_FILE), os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	al.file = file
+	al.size = info.Size()
+	return nil
+}
+
+/** Appends an entry to the log. */
+func (al *AuditLog) Record(entry *AuditEntry) {
+	if al == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("Could not encode audit entry: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+	
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	
+	if al.file == nil {
+		// A previous rotation failed; try again
+		if err = al.open(); err != nil {
+			fmt.Printf("Could not reopen audit log: %v\n", err)
+			return
+		}
+	}
+	if al.maxSize > 0 && al.size > 0 && al.size + int64(len(line)) > al.maxSize {
+		al.rotate()
+	}
+	if al.file == nil {
+		return
+	}
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		fmt.Printf("Could not write audit entry: %v\n", err)
+	}
+}
+
+/** Starts a new log file. The caller must hold the lock. */
+func (al *AuditLog) rotate() {
+	al.file.Close()
+	al.file = nil
+	var rotated string = fmt.Sprintf("audit-%v.log", time.Now().UTC().Format("20060102T150405.000000000"))
+	err := os.Rename(filepath.Join(al.dir, AUDIT_FILE), filepath.Join(al.dir, rotated))
+	if err != nil {
+		fmt.Printf("Could not rotate audit log: %v\n", err)
+	}
+	if err = al.open(); err != nil {
+		fmt.Printf("Could not reopen audit log: %v\n", err)
+	}
+	
+	if al.maxFiles > 0 {
+		files, err := al.files()
+		if err == nil && len(files) - 1 > al.maxFiles {
+			for _, old := range files[:len(files) - 1 - al.maxFiles] {
+				os.Remove(old)
+			}
+		}
+	}
+}
+
+/** Returns the paths of the log files, oldest first. */
+func (al *AuditLog) files() ([]string, error) {
+	entries, err := ioutil.ReadDir(al.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string = make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "audit-") && strings.HasSuffix(entry.Name(), ".log") {
+			files = append(files, filepath.Join(al.dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return append(files, filepath.Join(al.dir, AUDIT_FILE)), nil
+}
+
+/** Selects entries from the audit log. Empty fields match everything. */
+type AuditFilter struct {
+	User string
+	Uuid string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+func (af *AuditFilter) matches(entry *AuditEntry) bool {
+	if af.User != "" && entry.User != af.User {
+		return false
+	}
+	if !af.Since.IsZero() && entry.Time.Before(af.Since) {
+		return false
+	}
+	if !af.Until.IsZero() && !entry.Time.Before(af.Until) {
+		return false
+	}
+	if af.Uuid == "" {
+		return true
+	}
+	for _, u := range entry.Uuids {
+		if u == af.Uuid {
+			return true
+		}
+	}
+	return false
+}
+
+/** Returns the most recent entries that match the filter, oldest first. */
+func (al *AuditLog) Query(filter *AuditFilter) ([]*AuditEntry, error) {
+	al.lock.Lock()
+	files, err := al.files()
+	al.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	
+	var results []*AuditEntry = make([]*AuditEntry, 0)
+	for _, path := range files {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue // rotated away while we were reading
+		} else if err != nil {
+			return nil, err
+		}
+		var scanner *bufio.Scanner = bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64 * 1024), 1 << 20)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || !filter.matches(&entry) {
+				continue
+			}
+			results = append(results, &entry)
+			if len(results) > filter.Limit {
+				results = results[1:]
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+type auditKey struct {}
+
+/** Starts an audit entry for an HTTP request. */
+func (al *AuditLog) newEntry(endpoint string, r *http.Request) *AuditEntry {
+	var entry *AuditEntry = &AuditEntry{
+		Time: time.Now().UTC(),
+		User: principalName(al.auth.Authenticate(r)),
+		Endpoint: endpoint,
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	entry.Client = host
+	return entry
+}
+
+/** Wraps a handler so that each request is recorded in the log under the
+	specified endpoint name. The handler describes what was accessed with
+	noteAccess. */
+func (al *AuditLog) Wrap(endpoint string, handler http.Handler) http.Handler {
+	if al == nil {
+		return handler
+	}
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		var entry *AuditEntry = al.newEntry(endpoint, r)
+		var sr *statusRecorder = &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(sr, r.WithContext(context.WithValue(r.Context(), auditKey{}, entry)))
+		entry.Status = sr.status
+		al.Record(entry)
+	})
+}
+
+/** Records a request that arrived as a message on the WebSocket opened by R.
+	STATUS is the status an HTTP request would have had, and ERR, if not nil,
+	is an error that was sent instead of the result. */
+func (al *AuditLog) RecordMessage(endpoint string, r *http.Request, uuids []uuid.UUID, startTime int64, endTime int64, status int, err error) {
+	if al == nil {
+		return
+	}
+	var entry *AuditEntry = al.newEntry(endpoint, r)
+	entry.Uuids = auditUuids(uuids)
+	entry.Start = startTime
+	entry.End = endTime
+	entry.Status = status
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	al.Record(entry)
+}
+
+/** Notes, in the audit entry of a request, the streams and time range it
+	accessed. */
+func noteAccess(r *http.Request, uuids []uuid.UUID, startTime int64, endTime int64) {
+	entry, ok := r.Context().Value(auditKey{}).(*AuditEntry)
+	if !ok {
+		return
+	}
+	entry.Uuids = auditUuids(uuids)
+	entry.Start = startTime
+	entry.End = endTime
+}
+
+/** Notes, in the audit entry of a request, a metadata query it made. */
+func noteQuery(r *http.Request, query string) {
+	entry, ok := r.Context().Value(auditKey{}).(*AuditEntry)
+	if !ok {
+		return
+	}
+	if len(query) > MAX_AUDITED_QUERY {
+		query = query[:MAX_AUDITED_QUERY]
+	}
+	entry.Query = query
+}
+
+/** Notes, in the audit entry of a request, an error that occurred after the
+	response had begun. */
+func noteError(r *http.Request, err error) {
+	entry, ok := r.Context().Value(auditKey{}).(*AuditEntry)
+	if ok && err != nil {
+		entry.Error = err.Error()
+	}
+}
+
+func auditUuids(uuids []uuid.UUID) []string {
+	var strs []string = make([]string, len(uuids))
+	for i, u := range uuids {
+		strs[i] = u.String()
+	}
+	return strs
+}
+
+/** Captures the status of a response. */
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if !sr.wroteHeader {
+		sr.status = status
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(p)
+}
+
+/** Serves GET requests to /audit, which return the entries of the audit log
+	matching the query parameters user, uuid, since and until, the last two
+	as RFC 3339 times. At most limit entries, the most recent, are returned.
+	Only administrators may query the log. */
+func (al *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(al.auth, w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("You must send a GET request to query the audit log."))
+		return
+	}
+	
+	var params = r.URL.Query()
+	var filter *AuditFilter = &AuditFilter{
+		User: params.Get("user"),
+		Limit: 1000,
+	}
+	var err error
+	if uuidStr := params.Get("uuid"); uuidStr != "" {
+		var parsed uuid.UUID = uuid.Parse(uuidStr)
+		if parsed == nil {
+			err = fmt.Errorf("Invalid UUID %v", uuidStr)
+		} else {
+			filter.Uuid = parsed.String()
+		}
+	}
+	if since := params.Get("since"); since != "" && err == nil {
+		filter.Since, err = time.Parse(time.RFC3339Nano, since)
+	}
+	if until := params.Get("until"); until != "" && err == nil {
+		filter.Until, err = time.Parse(time.RFC3339Nano, until)
+	}
+	if limit := params.Get("limit"); limit != "" && err == nil {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err == nil && (filter.Limit < 1 || filter.Limit > MAX_AUDIT_RESULTS) {
+			err = fmt.Errorf("limit must be between 1 and %v", MAX_AUDIT_RESULTS)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid audit query: %v", err)))
+		return
+	}
+	
+	entries, err := al.Query(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Could not read audit log: %v", err)))
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+/** The name of the cookie in which browsers present their token. */
+const TOKEN_COOKIE string = "plotter_token"
+
+/** The header in which browsers present their CSRF token. */
+const CSRF_HEADER string = "X-CSRF-Token"
+
+/** A Principal is the user on whose behalf a request is made. TAGS are the
+	metadata tags (see tagconfig.json) that the user may access. An ADMIN may
+	also use the administrative endpoints. */
+type Principal struct {
+	User string `json:"user"`
+	Tags []string `json:"tags"`
+	Admin bool `json:"admin,omitempty"`
+}
+
+/** Returns true if the principal holds at least one of the specified tags. */
+func (p *Principal) HasAnyTag(tags []string) bool {
+	for _, have := range p.Tags {
+		for _, want := range tags {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/** An Authenticator maps tokens, presented either as a bearer token in the
+	Authorization header or in the plotter_token cookie, to principals. */
+type Authenticator struct {
+	tokens map[string]*Principal
+	csrfKey []byte
+}
+
+/** Reads a tokens file: a JSON document mapping each token to a principal. */
+func LoadAuthenticator(filename string) (*Authenticator, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var tokens map[string]*Principal
+	err = json.Unmarshal(contents, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	
+	// CSRF tokens only need to outlive the pages that hold them, so a new key
+	// on every restart will do
+	var csrfKey []byte = make([]byte, 32)
+	_, err = rand.Read(csrfKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{tokens: tokens, csrfKey: csrfKey}, nil
+}
+
+/** Returns the principal that made the request, or nil if the request is
+	anonymous. A nil Authenticator treats every request as anonymous. */
+func (a *Authenticator) Authenticate(r *http.Request) *Principal {
+	if a == nil {
+		return nil
+	}
+	var token string = requestToken(r)
+	if token == "" {
+		return nil
+	}
+	return a.tokens[token]
+}
+
+/** Extracts the token presented with the request, or returns the empty string
+	if there is none. */
+func requestToken(r *http.Request) string {
+	var header string = r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	cookie, err := r.Cookie(TOKEN_COOKIE)
+	if err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+/** Returns the name of the principal, or the empty string for anonymous
+	requests. */
+func principalName(p *Principal) string {
+	if p == nil {
+		return ""
+	}
+	return p.User
+}
+
+/** Returns the URL at which to query the metadata server on behalf of the
+	principal, so that only the streams its tags allow are visible. Anonymous
+	requests get the metadata server's default, the public streams. */
+func metadataURL(mdServer string, p *Principal) string {
+	if p == nil {
+		return mdServer
+	}
+	if p.Admin {
+		return mdServer + "?tags=all"
+	}
+	if len(p.Tags) == 0 {
+		return mdServer
+	}
+	return mdServer + "?tags=" + strings.Join(p.Tags, ",")
+}
+
+/** Returns the CSRF token that goes with a cookie token. */
+func (a *Authenticator) csrfToken(token string) string {
+	var mac hash.Hash = hmac.New(sha256.New, a.csrfKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/** Returns true if the request is safe from cross-site request forgery: it
+	doesn't change anything, doesn't carry the token cookie, or carries the
+	CSRF token that goes with the cookie. Requests authenticated with an
+	Authorization header can't be forged by another site. */
+func (a *Authenticator) CheckCSRF(r *http.Request) bool {
+	if a == nil || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return true
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+	cookie, err := r.Cookie(TOKEN_COOKIE)
+	if err != nil {
+		return true
+	}
+	var expected string = a.csrfToken(cookie.Value)
+	return hmac.Equal([]byte(r.Header.Get(CSRF_HEADER)), []byte(expected))
+}
+
+/** Wraps a handler so that requests that fail CheckCSRF are refused. */
+func (a *Authenticator) RequireCSRF(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		if !a.CheckCSRF(r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Missing or invalid " + CSRF_HEADER + " header; GET /csrf for a token."))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+/** Serves GET requests to /csrf, which return the CSRF token that browsers
+	authenticated by cookie must send, in the X-CSRF-Token header, with
+	requests that change anything. */
+func (a *Authenticator) ServeCSRF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("You must send a GET request for a CSRF token."))
+		return
+	}
+	cookie, err := r.Cookie(TOKEN_COOKIE)
+	if err != nil || a.tokens[cookie.Value] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("CSRF tokens are only issued to browsers authenticated by cookie."))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"token": a.csrfToken(cookie.Value)})
+}
+
+/** Checks that the request was made by an administrator. If not, writes an
+	error to the response and returns false. */
+func requireAdmin(a *Authenticator, w http.ResponseWriter, r *http.Request) bool {
+	var p *Principal = a.Authenticate(r)
+	if p == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You must authenticate as an administrator."))
+		return false
+	}
+	if !p.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Only administrators may use this endpoint."))
+		return false
+	}
+	return true
+}
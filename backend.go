@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	
+	quasar "github.com/SoftwareDefinedBuildings/webgl-plotter/quasar"
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+type Point = quasar.Point
+
+/** A Backend is an archive of streams from which the plotter reads data.
+	Streams are identified by UUID, and times are in nanoseconds since the
+	epoch. The router, the caches and the HTTP handlers only see this
+	interface, so they work the same whatever the archive. Implementations
+	must be safe for concurrent use. */
+type Backend interface {
+	/* Returns statistical records in windows of width 2^PW nanoseconds, aligned
+	   to their width, between STARTTIME (inclusive) and ENDTIME (exclusive). */
+	QueryStatisticalValues(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) ([]StatRecord, error)
+	
+	/* Returns statistical records in consecutive windows of exactly WIDTH
+	   nanoseconds, the first of which begins at STARTTIME. Windows that would
+	   extend past ENDTIME are left out. */
+	QueryWindowValues(uuidBytes uuid.UUID, startTime int64, endTime int64, width uint64) ([]StatRecord, error)
+	
+	/* Returns the times of the earliest and latest points of each stream, or
+	   INVALID_TIME for a stream with no points. */
+	QueryBrackets(uuids []uuid.UUID) ([]Bracket, error)
+	
+	/* Returns the points of a stream between STARTTIME (inclusive) and ENDTIME
+	   (exclusive). */
+	QueryRawValues(uuidBytes uuid.UUID, startTime int64, endTime int64) ([]Point, error)
+	
+	/* Returns true if the backend is loaded enough that background work, such
+	   as prefetching, should wait. */
+	Busy() bool
+	
+	Close()
+}
+
+/** Creates a backend from the configuration. The keys that configure the
+	backend are named PREFIX followed by the name of the setting, such as
+	"addr". DATACONN and BRACKETCONN are the default numbers of connections,
+	for backends that use them. */
+type BackendFactory func (config map[string]interface{}, prefix string, dataConn int, bracketConn int) (Backend, error)
+
+/** The types of backend, by the name given to them in the configuration. */
+var backendTypes map[string]BackendFactory = map[string]BackendFactory{
+	"quasar": NewQuasarBackend,
+	"files": NewFileBackend,
+}
+
+/** Creates a backend of the type given by the key PREFIX + "type", which
+	defaults to "quasar". */
+func NewBackend(config map[string]interface{}, prefix string, dataConn int, bracketConn int) (Backend, error) {
+	var backendType string = "quasar"
+	if raw, ok := config[prefix + "type"]; ok {
+		backendType = raw.(string)
+	}
+	factory, ok := backendTypes[backendType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend type \"%v\" in key \"%vtype\"", backendType, prefix)
+	}
+	return factory(config, prefix, dataConn, bracketConn)
+}
+
+/** A QuasarBackend reads data from a QUASAR cluster. It uses separate sets
+	of connections for data and bracket queries, so that slow data queries
+	don't hold up bracket queries. */
+type QuasarBackend struct {
+	data *quasar.DataRequester
+	bracket *quasar.DataRequester
+}
+
+/** Connects to the replicas of a QUASAR cluster. The addresses of the
+	replicas are read, comma-separated, from the key PREFIX + "addr"; the keys
+	PREFIX + "num_data_conn" and PREFIX + "num_bracket_conn" optionally
+	override the default numbers of connections. */
+func NewQuasarBackend(config map[string]interface{}, prefix string, dataConn int, bracketConn int) (Backend, error) {
+	addr, ok := config[prefix + "addr"]
+	if !ok {
+		return nil, fmt.Errorf("Configuration file is missing required key \"%vaddr\"", prefix)
+	}
+	numData, err := optionalIntConfig(config, prefix + "num_data_conn", dataConn)
+	if err != nil {
+		return nil, err
+	}
+	numBracket, err := optionalIntConfig(config, prefix + "num_bracket_conn", bracketConn)
+	if err != nil {
+		return nil, err
+	}
+	
+	var addrs []string = parseAddrList(addr.(string))
+	dr, err := quasar.NewDataRequester(addrs, numData, 8, false)
+	if err != nil {
+		return nil, err
+	}
+	br, err := quasar.NewDataRequester(addrs, numBracket, 8, true)
+	if err != nil {
+		dr.Stop()
+		return nil, err
+	}
+	
+	var noteError func (error) = func (err error) {
+		recentErrors.Add("database", err)
+	}
+	dr.OnError(noteError)
+	br.OnError(noteError)
+	return &QuasarBackend{data: dr, bracket: br}, nil
+}
+
+func (qb *QuasarBackend) QueryStatisticalValues(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) ([]StatRecord, error) {
+	return qb.data.QueryStatisticalValues(uuidBytes, startTime, endTime, pw)
+}
+
+func (qb *QuasarBackend) QueryWindowValues(uuidBytes uuid.UUID, startTime int64, endTime int64, width uint64) ([]StatRecord, error) {
+	return qb.data.QueryWindowValues(uuidBytes, startTime, endTime, width)
+}
+
+func (qb *QuasarBackend) QueryBrackets(uuids []uuid.UUID) ([]Bracket, error) {
+	return qb.bracket.QueryBrackets(uuids)
+}
+
+func (qb *QuasarBackend) QueryRawValues(uuidBytes uuid.UUID, startTime int64, endTime int64) ([]Point, error) {
+	return qb.data.QueryRawValues(uuidBytes, startTime, endTime)
+}
+
+func (qb *QuasarBackend) Busy() bool {
+	return qb.data.Busy()
+}
+
+func (qb *QuasarBackend) Close() {
+	qb.data.Stop()
+	qb.bracket.Stop()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/** How long after a window ends we assume its data may still arrive. Records
+	for windows that end later than this are not cached, so that they are
+	never served stale. */
+const SETTLE_DELAY time.Duration = 5 * time.Minute
+
+/** Returns the time before which data is assumed to have settled. */
+func settledTime() int64 {
+	return time.Now().Add(-SETTLE_DELAY).UnixNano()
+}
+
+/** A RecordCache holds recently computed statistical records, evicting the
+	least recently used entries once it holds more than its capacity, which is
+	measured in records. */
+type RecordCache struct {
+	capacity int
+	size int
+	entries map[string]*list.Element
+	order *list.List // most recently used at the front
+	lock *sync.Mutex
+	hits uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	key string
+	records []StatRecord
+}
+
+func NewRecordCache(capacity int) *RecordCache {
+	return &RecordCache{
+		capacity: capacity,
+		size: 0,
+		entries: make(map[string]*list.Element),
+		order: list.New(),
+		lock: &sync.Mutex{},
+	}
+}
+
+/** Returns the records cached under KEY. The caller must not modify them. A
+	nil cache never holds anything. */
+func (rc *RecordCache) Get(key string) ([]StatRecord, bool) {
+	if rc == nil {
+		return nil, false
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	elem, ok := rc.entries[key]
+	if !ok {
+		atomic.AddUint64(&rc.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&rc.hits, 1)
+	rc.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).records, true
+}
+
+/** Caches RECORDS under KEY. The caller must not modify them afterwards. */
+func (rc *RecordCache) Put(key string, records []StatRecord) {
+	if rc == nil || len(records) > rc.capacity {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	
+	if elem, ok := rc.entries[key]; ok {
+		rc.size -= len(elem.Value.(*cacheEntry).records)
+		rc.order.Remove(elem)
+	}
+	rc.entries[key] = rc.order.PushFront(&cacheEntry{key: key, records: records})
+	rc.size += len(records)
+	
+	for rc.size > rc.capacity {
+		var oldest *list.Element = rc.order.Back()
+		var entry *cacheEntry = oldest.Value.(*cacheEntry)
+		rc.order.Remove(oldest)
+		delete(rc.entries, entry.key)
+		rc.size -= len(entry.records)
+	}
+}
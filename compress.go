@@ -0,0 +1,228 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	
+	brotli "github.com/andybalholm/brotli"
+	ws "github.com/gorilla/websocket"
+)
+
+/** Compression settings for responses. THRESHOLD is the smallest response, in
+	bytes, that is compressed; LEVEL is the compression level, from 1 (fastest)
+	to 9 (smallest). A nil Compression compresses nothing. */
+type Compression struct {
+	Threshold int
+	Level int
+}
+
+/** Reads the compression settings from the configuration file. Compression is
+	disabled if compression_level is 0. */
+func LoadCompression(config map[string]interface{}) (*Compression, error) {
+	level, err := optionalIntConfig(config, "compression_level", gzip.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := optionalIntConfig(config, "compression_threshold", 1024)
+	if err != nil {
+		return nil, err
+	}
+	if level == gzip.DefaultCompression {
+		level = 6
+	}
+	if level == 0 {
+		return nil, nil
+	}
+	if level < 1 || level > 9 {
+		return nil, fmt.Errorf("Configuration file must specify compression_level between 0 and 9")
+	}
+	return &Compression{Threshold: threshold, Level: level}, nil
+}
+
+/** Wraps a handler so that its responses are compressed with brotli or gzip,
+	whichever the client prefers among those it accepts. Responses smaller than
+	the threshold are sent as they are. */
+func (c *Compression) Wrap(handler http.Handler) http.Handler {
+	if c == nil {
+		return handler
+	}
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		var encoding string = acceptedEncoding(r)
+		
+		// Compressing part of a file would make the range meaningless
+		if encoding == "" || r.Header.Get("Range") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		
+		var cw *compressWriter = &compressWriter{
+			ResponseWriter: w,
+			compression: c,
+			encoding: encoding,
+		}
+		handler.ServeHTTP(cw, r)
+		cw.Close()
+	})
+}
+
+/** Like Wrap, but for handler functions. */
+func (c *Compression) WrapFunc(handler func (http.ResponseWriter, *http.Request)) http.Handler {
+	return c.Wrap(http.HandlerFunc(handler))
+}
+
+/** Passed to PrepareMessage for messages that are streamed, and whose size
+	is therefore not known in advance. */
+const UNKNOWN_SIZE int = -1
+
+/** Configures a WebSocket upgrader to negotiate permessage-deflate with
+	clients that support it. */
+func (c *Compression) ConfigureUpgrader(upgrader *ws.Upgrader) {
+	upgrader.EnableCompression = c != nil
+}
+
+/** Sets the compression level of a newly upgraded WebSocket. */
+func (c *Compression) ConfigureConn(conn *ws.Conn) {
+	if c != nil {
+		conn.SetCompressionLevel(c.Level)
+	}
+}
+
+/** Enables or disables compression of the next message on a WebSocket
+	according to its size. Messages of UNKNOWN_SIZE are always compressed.
+	Compression only happens if the client negotiated it. */
+func (c *Compression) PrepareMessage(conn *ws.Conn, size int) {
+	if c != nil {
+		conn.EnableWriteCompression(size == UNKNOWN_SIZE || size >= c.Threshold)
+	}
+}
+
+/** Returns "br" or "gzip" according to the Accept-Encoding header of the
+	request, or the empty string if the client accepts neither. */
+func acceptedEncoding(r *http.Request) string {
+	var gzipOK bool = false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		var fields []string = strings.Split(part, ";")
+		var coding string = strings.ToLower(strings.TrimSpace(fields[0]))
+		var refused bool = false
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				refused = err == nil && q == 0
+			}
+		}
+		if refused {
+			continue
+		}
+		if coding == "br" {
+			return "br"
+		}
+		if coding == "gzip" {
+			gzipOK = true
+		}
+	}
+	if gzipOK {
+		return "gzip"
+	}
+	return ""
+}
+
+/** Returns true if content of the specified type is worth compressing. */
+func compressible(contentType string) bool {
+	return !strings.HasPrefix(contentType, "image/") && !strings.HasPrefix(contentType, "video/") &&
+		!strings.HasPrefix(contentType, "audio/") && !strings.HasPrefix(contentType, "application/zip") &&
+		!strings.HasPrefix(contentType, "application/gzip")
+}
+
+/** A compressWriter holds back the start of a response until it has seen
+	enough of it to decide whether to compress it. */
+type compressWriter struct {
+	http.ResponseWriter
+	compression *Compression
+	encoding string
+	status int
+	buffer []byte
+	decided bool
+	encoder io.WriteCloser // nil if the response is not compressed
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buffer = append(cw.buffer, p...)
+	if len(cw.buffer) >= cw.compression.Threshold {
+		err := cw.decide(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+/** Sends the headers and the buffered start of the response, compressed if
+	COMPRESS is true and the response is of a suitable type. */
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	var header http.Header = cw.ResponseWriter.Header()
+	if header.Get("Content-Type") == "" && len(cw.buffer) != 0 {
+		// Sniff the type now, since net/http would see compressed bytes
+		header.Set("Content-Type", http.DetectContentType(cw.buffer))
+	}
+	
+	var bodyless bool = cw.status == http.StatusNoContent || cw.status == http.StatusNotModified
+	if compress && !bodyless && header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == "br" {
+			cw.encoder = brotli.NewWriterLevel(cw.ResponseWriter, cw.compression.Level)
+		} else {
+			cw.encoder, _ = gzip.NewWriterLevel(cw.ResponseWriter, cw.compression.Level)
+		}
+	}
+	
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	var buffered []byte = cw.buffer
+	cw.buffer = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buffered)
+	} else {
+		_, err = cw.ResponseWriter.Write(buffered)
+	}
+	return err
+}
+
+/** Finishes the response. Responses that never reached the threshold are sent
+	uncompressed. */
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		err := cw.decide(false)
+		if err != nil {
+			return err
+		}
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** The namespace from which the synthetic UUIDs of derived streams are
+	generated. Equal expressions always get the same UUID. */
+var DERIVED_NAMESPACE uuid.UUID = uuid.Parse("2f1c6a5e-7d8b-4c3a-9e21-5b0d4f6a8c17")
+
+/** The largest expression, in bytes, that we accept. */
+const MAX_EXPRESSION_SIZE int64 = 16 << 10
+
+/** How deeply derived streams may be nested: a stream whose inputs are all
+	stored has depth 1, and one with derived inputs is one deeper than the
+	deepest of them. Without a limit, each level could multiply the number of
+	queries that evaluating a stream makes. */
+const MAX_DERIVED_DEPTH int = 4
+
+var uuidToken *regexp.Regexp = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}")
+var numberToken *regexp.Regexp = regexp.MustCompile("^([0-9]+\\.?[0-9]*|\\.[0-9]+)([eE][-+]?[0-9]+)?")
+
+/** A node in the syntax tree of an expression. Nodes are evaluated over one
+	statistical window at a time: INPUTS holds the window of each input
+	stream, and the result bounds the derived stream in that window. OK is
+	false if the result is undefined, for example when dividing by an
+	interval that contains zero. */
+type exprNode interface {
+	eval(inputs []*StatRecord) (result StatRecord, ok bool)
+	String() string
+}
+
+type constNode struct {
+	value float64
+}
+
+func (n *constNode) eval(inputs []*StatRecord) (StatRecord, bool) {
+	return StatRecord{Min: n.value, Mean: n.value, Max: n.value, Count: math.MaxUint64}, true
+}
+
+func (n *constNode) String() string {
+	return strconv.FormatFloat(n.value, 'g', -1, 64)
+}
+
+type streamNode struct {
+	id uuid.UUID
+	index int // the position of this stream among the expression's inputs
+}
+
+func (n *streamNode) eval(inputs []*StatRecord) (StatRecord, bool) {
+	return *inputs[n.index], true
+}
+
+func (n *streamNode) String() string {
+	return n.id.String()
+}
+
+type negNode struct {
+	arg exprNode
+}
+
+func (n *negNode) eval(inputs []*StatRecord) (StatRecord, bool) {
+	a, ok := n.arg.eval(inputs)
+	return StatRecord{Min: -a.Max, Mean: -a.Mean, Max: -a.Min, Count: a.Count}, ok
+}
+
+func (n *negNode) String() string {
+	return "(-" + n.arg.String() + ")"
+}
+
+type binaryNode struct {
+	op byte
+	left exprNode
+	right exprNode
+}
+
+/** Combines the operands with interval arithmetic, so that the minimum and
+	maximum of the result bound every value the derived stream can take in
+	the window. The mean is the operator applied to the operands' means, which
+	is exact for sums and differences and an approximation otherwise. */
+func (n *binaryNode) eval(inputs []*StatRecord) (StatRecord, bool) {
+	a, okA := n.left.eval(inputs)
+	b, okB := n.right.eval(inputs)
+	if !okA || !okB {
+		return StatRecord{}, false
+	}
+	
+	var result StatRecord
+	result.Count = a.Count
+	if b.Count < result.Count {
+		result.Count = b.Count
+	}
+	
+	switch n.op {
+	case '+':
+		result.Min = a.Min + b.Min
+		result.Mean = a.Mean + b.Mean
+		result.Max = a.Max + b.Max
+	case '-':
+		result.Min = a.Min - b.Max
+		result.Mean = a.Mean - b.Mean
+		result.Max = a.Max - b.Min
+	case '*':
+		result.Min, result.Max = intervalBounds(a.Min * b.Min, a.Min * b.Max, a.Max * b.Min, a.Max * b.Max)
+		result.Mean = clamp(a.Mean * b.Mean, result.Min, result.Max)
+	case '/':
+		if b.Min <= 0 && b.Max >= 0 {
+			return StatRecord{}, false
+		}
+		result.Min, result.Max = intervalBounds(a.Min / b.Min, a.Min / b.Max, a.Max / b.Min, a.Max / b.Max)
+		result.Mean = clamp(a.Mean / b.Mean, result.Min, result.Max)
+	}
+	
+	return result, true
+}
+
+func (n *binaryNode) String() string {
+	return "(" + n.left.String() + " " + string(n.op) + " " + n.right.String() + ")"
+}
+
+type funcNode struct {
+	name string
+	args []exprNode
+}
+
+/** The number of arguments each function takes. */
+var derivedFunctions map[string]int = map[string]int{
+	"abs": 1,
+	"scale": 2,
+}
+
+func (n *funcNode) eval(inputs []*StatRecord) (StatRecord, bool) {
+	a, ok := n.args[0].eval(inputs)
+	if !ok {
+		return StatRecord{}, false
+	}
+	
+	switch n.name {
+	case "abs":
+		if a.Min >= 0 {
+			return a, true
+		} else if a.Max <= 0 {
+			return StatRecord{Min: -a.Max, Mean: -a.Mean, Max: -a.Min, Count: a.Count}, true
+		}
+		return StatRecord{Min: 0, Mean: math.Abs(a.Mean), Max: math.Max(-a.Min, a.Max), Count: a.Count}, true
+	case "scale":
+		return (&binaryNode{op: '*', left: n.args[0], right: n.args[1]}).eval(inputs)
+	}
+	return StatRecord{}, false
+}
+
+func (n *funcNode) String() string {
+	var args []string = make([]string, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.String()
+	}
+	return n.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func intervalBounds(values ...float64) (float64, float64) {
+	var lo float64 = values[0]
+	var hi float64 = values[0]
+	for _, v := range values[1:] {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	return lo, hi
+}
+
+func clamp(v float64, lo float64, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
+
+/** A recursive-descent parser for expressions over streams. The grammar is
+
+	expr    := term (('+' | '-') term)*
+	term    := unary (('*' | '/') unary)*
+	unary   := '-' unary | primary
+	primary := NUMBER | UUID | NAME '(' expr (',' expr)* ')' | '(' expr ')'
+
+	Streams are referred to by UUID. */
+type exprParser struct {
+	input string
+	pos int
+	inputs []uuid.UUID
+	inputIndex map[string]int
+}
+
+func parseExpression(input string) (root exprNode, inputs []uuid.UUID, err error) {
+	var p *exprParser = &exprParser{
+		input: input,
+		inputs: make([]uuid.UUID, 0),
+		inputIndex: make(map[string]int),
+	}
+	root, err = p.parseExpr()
+	if err != nil {
+		return
+	}
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		err = fmt.Errorf("Unexpected %q at position %v", p.input[p.pos:], p.pos)
+		return
+	}
+	if len(p.inputs) == 0 {
+		err = fmt.Errorf("An expression must refer to at least one stream")
+		return
+	}
+	inputs = p.inputs
+	return
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+/** Consumes the next character if it is C. */
+func (p *exprParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	left, err := p.parseTerm()
+	for err == nil {
+		var op byte
+		if p.accept('+') {
+			op = '+'
+		} else if p.accept('-') {
+			op = '-'
+		} else {
+			break
+		}
+		var right exprNode
+		right, err = p.parseTerm()
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		var op byte
+		if p.accept('*') {
+			op = '*'
+		} else if p.accept('/') {
+			op = '/'
+		} else {
+			break
+		}
+		var right exprNode
+		right, err = p.parseUnary()
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept('-') {
+		arg, err := p.parseUnary()
+		return &negNode{arg: arg}, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	p.skipSpace()
+	if p.pos == len(p.input) {
+		return nil, fmt.Errorf("Unexpected end of expression")
+	}
+	var rest string = p.input[p.pos:]
+	
+	if p.accept('(') {
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("Expected ')' at position %v", p.pos)
+		}
+		return inner, nil
+	}
+	
+	if match := uuidToken.FindString(rest); match != "" {
+		p.pos += len(match)
+		var id uuid.UUID = uuid.Parse(match)
+		var key string = id.String()
+		index, ok := p.inputIndex[key]
+		if !ok {
+			index = len(p.inputs)
+			p.inputIndex[key] = index
+			p.inputs = append(p.inputs, id)
+		}
+		return &streamNode{id: id, index: index}, nil
+	}
+	
+	if match := numberToken.FindString(rest); match != "" {
+		p.pos += len(match)
+		value, err := strconv.ParseFloat(match, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %v", match)
+		}
+		return &constNode{value: value}, nil
+	}
+	
+	var end int = 0
+	for end < len(rest) && (unicode.IsLetter(rune(rest[end])) || rest[end] == '_') {
+		end++
+	}
+	if end == 0 {
+		return nil, fmt.Errorf("Unexpected %q at position %v", rest[:1], p.pos)
+	}
+	var name string = strings.ToLower(rest[:end])
+	p.pos += end
+	numArgs, ok := derivedFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown function %v", name)
+	}
+	if !p.accept('(') {
+		return nil, fmt.Errorf("Expected '(' after %v", name)
+	}
+	var args []exprNode = make([]exprNode, 0, numArgs)
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.accept(',') {
+			break
+		}
+	}
+	if !p.accept(')') {
+		return nil, fmt.Errorf("Expected ')' at position %v", p.pos)
+	}
+	if len(args) != numArgs {
+		return nil, fmt.Errorf("%v takes %v argument(s); got %v", name, numArgs, len(args))
+	}
+	return &funcNode{name: name, args: args}, nil
+}
+
+/** A stream computed from other streams. */
+type DerivedStream struct {
+	Uuid uuid.UUID
+	Expression string
+	Inputs []uuid.UUID
+	root exprNode
+	depth int // zero until measured
+	leaves int64 // the stored streams queried to evaluate it, counted with repetition
+}
+
+/** Returns the number of queries for stored streams that evaluating the
+	stream makes, counting those made for derived inputs. */
+func (ds *DerivedStream) Leaves() int64 {
+	return ds.leaves
+}
+
+/** Evaluates the expression over windows of the input streams. RECORDS holds
+	the records of each input, in the order of INPUTS, all obtained with the
+	same range and point width, so that their windows line up. A window is
+	present in the result only if every input has a record for it. */
+func (ds *DerivedStream) Evaluate(records [][]StatRecord) []StatRecord {
+	var result []StatRecord = make([]StatRecord, 0)
+	var positions []int = make([]int, len(records))
+	var window []*StatRecord = make([]*StatRecord, len(records))
+	var i int
+	
+	for {
+		// Find the latest window at the head of any input
+		var latest int64 = QUASAR_LOW
+		for i = 0; i < len(records); i++ {
+			if positions[i] == len(records[i]) {
+				return result
+			}
+			if records[i][positions[i]].Time > latest {
+				latest = records[i][positions[i]].Time
+			}
+		}
+		
+		var aligned bool = true
+		for i = 0; i < len(records); i++ {
+			if records[i][positions[i]].Time < latest {
+				positions[i]++
+				aligned = false
+			}
+		}
+		if !aligned {
+			continue
+		}
+		
+		for i = 0; i < len(records); i++ {
+			window[i] = &records[i][positions[i]]
+			positions[i]++
+		}
+		record, ok := ds.root.eval(window)
+		if ok && !math.IsNaN(record.Mean) && !math.IsInf(record.Min, 0) && !math.IsInf(record.Max, 0) {
+			record.Time = latest
+			result = append(result, record)
+		}
+	}
+}
+
+/** Returned when a client defines a derived stream once the registry holds
+	as many as it may. */
+var errRegistryFull error = fmt.Errorf("Too many derived streams have been defined")
+
+/** Returned when a derived stream nests derived streams too deeply. */
+var errTooDeep error = fmt.Errorf("Derived streams may be nested at most %v deep", MAX_DERIVED_DEPTH)
+
+/** A DerivedRegistry keeps track of the derived streams that clients have
+	defined. It serves POST requests to /derived, whose body is an expression
+	and whose response gives the synthetic UUID of the new stream, and GET
+	requests, which list the derived streams. Only authenticated clients may
+	define streams, and only up to a limit; the streams they define are kept
+	in a DiskStore, if there is one, so that permalinks and workspaces that
+	refer to them keep working after a restart. */
+type DerivedRegistry struct {
+	streams map[string]*DerivedStream
+	lock *sync.RWMutex
+	auth *Authenticator
+	store *DiskStore
+	defined int
+	maxDefined int
+}
+
+func NewDerivedRegistry() *DerivedRegistry {
+	return &DerivedRegistry{
+		streams: make(map[string]*DerivedStream),
+		lock: &sync.RWMutex{},
+	}
+}
+
+/** Lets clients authenticated by AUTH define up to MAXDEFINED derived
+	streams, which are saved to STORE unless it is nil. The streams already in
+	STORE are registered, and count toward the limit. */
+func (dreg *DerivedRegistry) AllowDefinitions(auth *Authenticator, store *DiskStore, maxDefined int) error {
+	dreg.auth = auth
+	dreg.maxDefined = maxDefined
+	if store == nil {
+		return nil
+	}
+	
+	keys, err := store.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var saved derivedStreamJSON
+		_, err = store.Get(key, &saved)
+		if err != nil {
+			return fmt.Errorf("%v: %v", key, err)
+		}
+		ds, err := newDerivedStream(saved.Expression)
+		if err != nil {
+			return fmt.Errorf("%v: %v", saved.Expression, err)
+		}
+		dreg.lock.Lock()
+		if _, ok := dreg.streams[ds.Uuid.String()]; !ok {
+			dreg.streams[ds.Uuid.String()] = ds
+			dreg.defined++
+		}
+		dreg.lock.Unlock()
+	}
+	
+	// The streams were loaded in no particular order, so their inputs may
+	// only now be known to be derived
+	dreg.lock.Lock()
+	defer dreg.lock.Unlock()
+	for _, ds := range dreg.streams {
+		ds.depth = 0
+	}
+	for _, ds := range dreg.streams {
+		dreg.measure(ds)
+		if ds.depth > MAX_DERIVED_DEPTH {
+			return fmt.Errorf("%v: %v", ds.Expression, errTooDeep)
+		}
+	}
+	dreg.store = store
+	return nil
+}
+
+/** Works out how deeply DS nests derived streams and how many queries for
+	stored streams evaluating it makes, measuring its derived inputs first if
+	need be. The caller must hold the lock. */
+func (dreg *DerivedRegistry) measure(ds *DerivedStream) {
+	if ds.depth != 0 {
+		return
+	}
+	var depth int = 1
+	var leaves int64 = 0
+	for _, input := range ds.Inputs {
+		inner, ok := dreg.streams[input.String()]
+		if !ok || inner == ds {
+			leaves++
+			continue
+		}
+		dreg.measure(inner)
+		if inner.depth + 1 > depth {
+			depth = inner.depth + 1
+		}
+		leaves += inner.leaves
+	}
+	ds.depth = depth
+	ds.leaves = leaves
+}
+
+/** Parses an expression into the derived stream it defines. */
+func newDerivedStream(expression string) (*DerivedStream, error) {
+	root, inputs, err := parseExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	
+	var canonical string = root.String()
+	return &DerivedStream{
+		Uuid: uuid.NewSHA1(DERIVED_NAMESPACE, []byte(canonical)),
+		Expression: canonical,
+		Inputs: inputs,
+		root: root,
+	}, nil
+}
+
+/** Parses an expression and registers the derived stream it defines. */
+func (dreg *DerivedRegistry) Register(expression string) (*DerivedStream, error) {
+	ds, err := newDerivedStream(expression)
+	if err != nil {
+		return nil, err
+	}
+	
+	dreg.lock.Lock()
+	defer dreg.lock.Unlock()
+	if existing, ok := dreg.streams[ds.Uuid.String()]; ok {
+		return existing, nil
+	}
+	dreg.measure(ds)
+	if ds.depth > MAX_DERIVED_DEPTH {
+		return nil, errTooDeep
+	}
+	dreg.streams[ds.Uuid.String()] = ds
+	return ds, nil
+}
+
+/** Registers a derived stream defined by a client, saving it to the store.
+	Returns errTooDeep if it nests derived streams too deeply, and
+	errRegistryFull if the client may not define any more. */
+func (dreg *DerivedRegistry) define(ds *DerivedStream) (*DerivedStream, error) {
+	dreg.lock.Lock()
+	defer dreg.lock.Unlock()
+	if existing, ok := dreg.streams[ds.Uuid.String()]; ok {
+		return existing, nil
+	}
+	dreg.measure(ds)
+	if ds.depth > MAX_DERIVED_DEPTH {
+		return nil, errTooDeep
+	}
+	if dreg.defined >= dreg.maxDefined {
+		return nil, errRegistryFull
+	}
+	if dreg.store != nil {
+		err := dreg.store.Put(ds.Uuid.String(), ds.toJSON())
+		if err != nil {
+			return nil, err
+		}
+	}
+	dreg.streams[ds.Uuid.String()] = ds
+	dreg.defined++
+	return ds, nil
+}
+
+/** Returns the derived stream with the specified UUID, or nil if the UUID
+	does not belong to a derived stream. A nil registry has no streams. */
+func (dreg *DerivedRegistry) Lookup(id uuid.UUID) *DerivedStream {
+	if dreg == nil {
+		return nil
+	}
+	dreg.lock.RLock()
+	defer dreg.lock.RUnlock()
+	return dreg.streams[id.String()]
+}
+
+/** Registers every expression in a JSON file containing an array of
+	expressions. */
+func (dreg *DerivedRegistry) LoadFile(filename string) error {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var expressions []string
+	err = json.Unmarshal(contents, &expressions)
+	if err != nil {
+		return err
+	}
+	for _, expression := range expressions {
+		ds, err := dreg.Register(expression)
+		if err != nil {
+			return fmt.Errorf("%v: %v", expression, err)
+		}
+		fmt.Printf("Derived stream %v = %v\n", ds.Uuid.String(), ds.Expression)
+	}
+	return nil
+}
+
+type derivedStreamJSON struct {
+	Uuid string `json:"uuid"`
+	Expression string `json:"expression"`
+	Inputs []string `json:"inputs"`
+}
+
+func (ds *DerivedStream) toJSON() derivedStreamJSON {
+	var inputs []string = make([]string, len(ds.Inputs))
+	for i, input := range ds.Inputs {
+		inputs[i] = input.String()
+	}
+	return derivedStreamJSON{
+		Uuid: ds.Uuid.String(),
+		Expression: ds.Expression,
+		Inputs: inputs,
+	}
+}
+
+func (dreg *DerivedRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		dreg.lock.RLock()
+		var list []derivedStreamJSON = make([]derivedStreamJSON, 0, len(dreg.streams))
+		for _, ds := range dreg.streams {
+			list = append(list, ds.toJSON())
+		}
+		dreg.lock.RUnlock()
+		sort.Slice(list, func (i int, j int) bool {
+			return list[i].Expression < list[j].Expression
+		})
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+	
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("You must POST an expression to define a derived stream."))
+		return
+	}
+	
+	if dreg.auth.Authenticate(r) == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You must be logged in to define derived streams."))
+		return
+	}
+	
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_EXPRESSION_SIZE + 1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+		return
+	}
+	if int64(len(payload)) > MAX_EXPRESSION_SIZE {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("Expression may be at most %v bytes", MAX_EXPRESSION_SIZE)))
+		return
+	}
+	
+	ds, err := newDerivedStream(string(payload))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid expression: %v", err)))
+		return
+	}
+	
+	ds, err = dreg.define(ds)
+	if err == errTooDeep {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid expression: %v", err)))
+		return
+	} else if err == errRegistryFull {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Could not save derived stream: %v", err)))
+		return
+	}
+	
+	writeJSON(w, http.StatusOK, ds.toJSON())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** Serves GET requests to /export, which return the data of one stream as
+	CSV. The query parameters uuid, start, end and pw have the same meaning as
+	the fields of a request to /data, so pw may be a point width or a calendar
+	period such as "day@Europe/Berlin". Each row holds the start of a window
+	in nanoseconds and as a time in the rollup's time zone (UTC for point
+	widths), followed by the minimum, mean, maximum and count. */
+func (rt *Router) ServeExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("You must send a GET request to export data."))
+		return
+	}
+	
+	var params = r.URL.Query()
+	req, err := newDataRequest(params.Get("uuid"), params.Get("start"), params.Get("end"), params.Get("pw"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	noteAccess(r, []uuid.UUID{req.Uuid}, req.StartTime, req.EndTime)
+	if !rt.limits.Admit(w, r, rt.DataRequestCost(req)) {
+		return
+	}
+	
+	rt.usage.Count(req.Uuid.String())
+	records, err := rt.QueryData(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	
+	var loc *time.Location = time.UTC
+	if req.Rollup != nil {
+		loc = req.Rollup.Location
+	}
+	
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v.csv\"", req.Uuid.String()))
+	w.Write([]byte("time_ns,time,min,mean,max,count\n"))
+	for i := range records {
+		var record *StatRecord = &records[i]
+		w.Write([]byte(fmt.Sprintf("%v,%v,%v,%v,%v,%v\n", record.Time, time.Unix(0, record.Time).In(loc).Format(time.RFC3339Nano),
+			strconv.FormatFloat(record.Min, 'g', -1, 64), strconv.FormatFloat(record.Mean, 'g', -1, 64),
+			strconv.FormatFloat(record.Max, 'g', -1, 64), record.Count)))
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** The point width of the finest level of the index of a file. Queries at
+	finer point widths are computed from the points themselves. */
+const FILE_INDEX_FIRST_PW uint8 = 16
+
+/** The difference in point width between consecutive levels of the index. */
+const FILE_INDEX_STEP uint8 = 4
+
+/** The size, in bytes, of a point in a binary file: the time in nanoseconds
+	as a little-endian int64, followed by the value as a little-endian
+	float64. */
+const BINARY_POINT_SIZE int64 = 16
+
+/** A FileBackend serves streams from files in a local directory, for use
+	without a QUASAR cluster. Stream UUID is read from UUID.csv or UUID.bin.
+	A CSV file has a time and a value on each line; the time is in
+	nanoseconds since the epoch or in RFC 3339 form, and lines beginning with
+	'#' are ignored, as is a header line. A binary file is a sequence of
+	points in the format described by BINARY_POINT_SIZE.
+	
+	A file is loaded the first time its stream is queried, and again whenever
+	it changes. Loading builds an index of statistical records at every
+	FILE_INDEX_STEP point widths from FILE_INDEX_FIRST_PW, so that queries at
+	any resolution only summarize a few records per window.
+	
+	Like QUASAR, a FileBackend only stores data; the metadata of the streams
+	still comes from the metadata server. */
+type FileBackend struct {
+	dir string
+	lock *sync.Mutex
+	streams map[string]*fileStream
+}
+
+/** The points of a stream loaded from a file, sorted by time, and their
+	index. Level i of the index holds records in windows of width 2^pw, where
+	pw is FILE_INDEX_FIRST_PW + i * FILE_INDEX_STEP. */
+type fileStream struct {
+	path string
+	modTime time.Time
+	size int64
+	points []Point
+	levels [][]StatRecord
+}
+
+/** Creates a FileBackend for the directory given by the key PREFIX + "dir".
+	The numbers of connections don't apply to files. */
+func NewFileBackend(config map[string]interface{}, prefix string, dataConn int, bracketConn int) (Backend, error) {
+	dir, ok := config[prefix + "dir"]
+	if !ok {
+		return nil, fmt.Errorf("Configuration file is missing required key \"%vdir\"", prefix)
+	}
+	info, err := os.Stat(dir.(string))
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", dir)
+	}
+	return &FileBackend{
+		dir: dir.(string),
+		lock: &sync.Mutex{},
+		streams: make(map[string]*fileStream),
+	}, nil
+}
+
+/** Returns the stream with the specified UUID, loading its file if it hasn't
+	been loaded or has changed since. Returns nil if there is no file for the
+	stream. */
+func (fb *FileBackend) stream(uuidBytes uuid.UUID) (*fileStream, error) {
+	var name string = uuidBytes.String()
+	var path string
+	var info os.FileInfo
+	var err error
+	for _, ext := range []string{".csv", ".bin"} {
+		path = filepath.Join(fb.dir, name + ext)
+		info, err = os.Stat(path)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	
+	fb.lock.Lock()
+	stream, ok := fb.streams[name]
+	fb.lock.Unlock()
+	if ok && stream.path == path && stream.modTime.Equal(info.ModTime()) && stream.size == info.Size() {
+		return stream, nil
+	}
+	
+	// Concurrent queries may load the same file twice, which is harmless
+	stream, err = loadFileStream(path, info)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load %v: %v", path, err)
+	}
+	fb.lock.Lock()
+	fb.streams[name] = stream
+	fb.lock.Unlock()
+	return stream, nil
+}
+
+func loadFileStream(path string, info os.FileInfo) (*fileStream, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	
+	var points []Point
+	if strings.HasSuffix(path, ".bin") {
+		points, err = readBinaryPoints(file, info.Size())
+	} else {
+		points, err = readCSVPoints(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	sort.SliceStable(points, func (i int, j int) bool {
+		return points[i].Time < points[j].Time
+	})
+	return &fileStream{
+		path: path,
+		modTime: info.ModTime(),
+		size: info.Size(),
+		points: points,
+		levels: buildIndex(points),
+	}, nil
+}
+
+func readBinaryPoints(r io.Reader, size int64) ([]Point, error) {
+	if size % BINARY_POINT_SIZE != 0 {
+		return nil, fmt.Errorf("Size %v is not a multiple of %v bytes", size, BINARY_POINT_SIZE)
+	}
+	var buf []byte = make([]byte, size)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	var points []Point = make([]Point, size / BINARY_POINT_SIZE)
+	for i := range points {
+		var raw []byte = buf[int64(i) * BINARY_POINT_SIZE:]
+		points[i] = Point{
+			Time: int64(binary.LittleEndian.Uint64(raw)),
+			Value: math.Float64frombits(binary.LittleEndian.Uint64(raw[8:])),
+		}
+	}
+	return points, nil
+}
+
+func readCSVPoints(r io.Reader) ([]Point, error) {
+	var reader *csv.Reader = csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	
+	var points []Point = make([]Point, 0)
+	var first bool = true
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Line %v has no value", line)
+		}
+		
+		t, timeErr := parseFileTime(fields[0])
+		value, valueErr := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if first && (timeErr != nil || valueErr != nil) {
+			first = false
+			continue // a header
+		}
+		first = false
+		if timeErr != nil {
+			return nil, fmt.Errorf("Line %v: %v", line, timeErr)
+		}
+		if valueErr != nil {
+			return nil, fmt.Errorf("Line %v: invalid value %q", line, fields[1])
+		}
+		if t < QUASAR_LOW || t > QUASAR_HIGH {
+			return nil, fmt.Errorf("Line %v: time %v is out of range", line, t)
+		}
+		points = append(points, Point{Time: t, Value: value})
+	}
+	return points, nil
+}
+
+/** Parses a time in a CSV file, given in nanoseconds or in RFC 3339 form. */
+func parseFileTime(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	nanos, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return nanos, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.UnixNano(), nil
+}
+
+/** Builds the levels of the index of a stream, each from the one before,
+	stopping once a level has a single record. */
+func buildIndex(points []Point) [][]StatRecord {
+	var levels [][]StatRecord = make([][]StatRecord, 0)
+	if len(points) == 0 {
+		return levels
+	}
+	
+	var records []StatRecord = pointRecords(points)
+	for pw := FILE_INDEX_FIRST_PW; pw < 64; pw += FILE_INDEX_STEP {
+		var first int64 = (records[0].Time >> pw) << pw
+		records = summarizeRecords(records, first, uint64(1) << pw)
+		levels = append(levels, records)
+		if len(records) == 1 {
+			break
+		}
+	}
+	return levels
+}
+
+/** Treats each point as a record of a window containing only that point. */
+func pointRecords(points []Point) []StatRecord {
+	var records []StatRecord = make([]StatRecord, len(points))
+	for i, point := range points {
+		records[i] = StatRecord{Time: point.Time, Min: point.Value, Mean: point.Value, Max: point.Value, Count: 1}
+	}
+	return records
+}
+
+/** Combines RECORDS, which are sorted by time, into consecutive windows of
+	WIDTH nanoseconds, the first of which begins at FIRST. Each record must
+	start no earlier than FIRST and lie within a single window. Empty windows
+	are left out. */
+func summarizeRecords(records []StatRecord, first int64, width uint64) []StatRecord {
+	var result []StatRecord = make([]StatRecord, 0)
+	var current int64 = -1
+	var sum float64
+	for i := range records {
+		var record *StatRecord = &records[i]
+		var window int64 = int64(uint64(record.Time - first) / width)
+		if window != current || len(result) == 0 {
+			if len(result) != 0 {
+				result[len(result) - 1].Mean = sum / float64(result[len(result) - 1].Count)
+			}
+			result = append(result, StatRecord{
+				Time: first + int64(uint64(window) * width),
+				Min: record.Min,
+				Max: record.Max,
+			})
+			current = window
+			sum = 0
+		}
+		var summary *StatRecord = &result[len(result) - 1]
+		summary.Min = math.Min(summary.Min, record.Min)
+		summary.Max = math.Max(summary.Max, record.Max)
+		summary.Count += record.Count
+		sum += record.Mean * float64(record.Count)
+	}
+	if len(result) != 0 {
+		result[len(result) - 1].Mean = sum / float64(result[len(result) - 1].Count)
+	}
+	return result
+}
+
+/** Returns the records, from the coarsest level of the index that fits, that
+	lie in [STARTTIME, ENDTIME). A level fits if its windows are no wider than
+	ALIGNMENT, a power of two to which STARTTIME and the windows of the query
+	are aligned, so that each of its records falls in a single window. If no
+	level fits, the points themselves are used. */
+func (stream *fileStream) recordsFor(startTime int64, endTime int64, alignment uint64) []StatRecord {
+	var level int = -1
+	for i := range stream.levels {
+		var pw uint8 = FILE_INDEX_FIRST_PW + uint8(i) * FILE_INDEX_STEP
+		if uint64(1) << pw > alignment {
+			break
+		}
+		level = i
+	}
+	
+	if level == -1 {
+		return pointRecords(stream.pointsIn(startTime, endTime))
+	}
+	return levelRecordsIn(stream.levels[level], startTime, endTime)
+}
+
+/** Returns the points in [STARTTIME, ENDTIME). */
+func (stream *fileStream) pointsIn(startTime int64, endTime int64) []Point {
+	var lo int = sort.Search(len(stream.points), func (i int) bool {
+		return stream.points[i].Time >= startTime
+	})
+	var hi int = sort.Search(len(stream.points), func (i int) bool {
+		return stream.points[i].Time >= endTime
+	})
+	return stream.points[lo:hi]
+}
+
+/** Returns the records of a level of the index that begin in
+	[STARTTIME, ENDTIME). */
+func levelRecordsIn(records []StatRecord, startTime int64, endTime int64) []StatRecord {
+	var lo int = sort.Search(len(records), func (i int) bool {
+		return records[i].Time >= startTime
+	})
+	var hi int = sort.Search(len(records), func (i int) bool {
+		return records[i].Time >= endTime
+	})
+	return records[lo:hi]
+}
+
+/** Appends to OUT records that together summarize exactly the points in
+	[STARTTIME, ENDTIME), in order. The middle of the range is covered by the
+	records of LEVEL whose windows lie entirely inside it, and the edges by
+	finer levels, down to the points themselves. */
+func (stream *fileStream) cover(level int, startTime int64, endTime int64, out []StatRecord) []StatRecord {
+	if startTime >= endTime {
+		return out
+	}
+	if level < 0 {
+		return append(out, pointRecords(stream.pointsIn(startTime, endTime))...)
+	}
+	
+	var pw uint8 = FILE_INDEX_FIRST_PW + uint8(level) * FILE_INDEX_STEP
+	var inner int64 = (((startTime - 1) >> pw) + 1) << pw // rounded up
+	var outer int64 = (endTime >> pw) << pw // rounded down
+	if inner < startTime || inner >= outer {
+		return stream.cover(level - 1, startTime, endTime, out)
+	}
+	out = stream.cover(level - 1, startTime, inner, out)
+	out = append(out, levelRecordsIn(stream.levels[level], inner, outer)...)
+	return stream.cover(level - 1, outer, endTime, out)
+}
+
+func (fb *FileBackend) QueryStatisticalValues(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) ([]StatRecord, error) {
+	stream, err := fb.stream(uuidBytes)
+	if err != nil || stream == nil {
+		return []StatRecord{}, err
+	}
+	
+	var first int64 = (startTime >> pw) << pw
+	if first >= endTime {
+		return []StatRecord{}, nil
+	}
+	// The last window is the one containing ENDTIME - 1, which may run past ENDTIME
+	var last int64 = ((endTime - 1) >> pw) << pw
+	var limit int64 = last + int64(uint64(1) << pw)
+	if limit < last {
+		limit = math.MaxInt64
+	}
+	return summarizeRecords(stream.recordsFor(first, limit, uint64(1) << pw), first, uint64(1) << pw), nil
+}
+
+func (fb *FileBackend) QueryWindowValues(uuidBytes uuid.UUID, startTime int64, endTime int64, width uint64) ([]StatRecord, error) {
+	stream, err := fb.stream(uuidBytes)
+	if err != nil || stream == nil || width == 0 || endTime <= startTime {
+		return []StatRecord{}, err
+	}
+	
+	var windows uint64 = uint64(endTime - startTime) / width
+	var result []StatRecord = make([]StatRecord, 0)
+	var records []StatRecord
+	
+	// The windows need not be aligned to the index, so each is covered
+	// separately, skipping those without points
+	var next int = sort.Search(len(stream.points), func (i int) bool {
+		return stream.points[i].Time >= startTime
+	})
+	for next < len(stream.points) {
+		var window uint64 = uint64(stream.points[next].Time - startTime) / width
+		if window >= windows {
+			break
+		}
+		var windowStart int64 = startTime + int64(window * width)
+		var windowEnd int64 = windowStart + int64(width)
+		records = stream.cover(len(stream.levels) - 1, windowStart, windowEnd, records[:0])
+		result = append(result, summarizeRecords(records, windowStart, width)...)
+		next = sort.Search(len(stream.points), func (i int) bool {
+			return stream.points[i].Time >= windowEnd
+		})
+	}
+	return result, nil
+}
+
+func (fb *FileBackend) QueryBrackets(uuids []uuid.UUID) ([]Bracket, error) {
+	var brackets []Bracket = make([]Bracket, len(uuids))
+	for i, uuidBytes := range uuids {
+		brackets[i] = Bracket{Left: INVALID_TIME, Right: INVALID_TIME}
+		stream, err := fb.stream(uuidBytes)
+		if err != nil {
+			return nil, err
+		}
+		if stream != nil && len(stream.points) != 0 {
+			brackets[i] = Bracket{Left: stream.points[0].Time, Right: stream.points[len(stream.points) - 1].Time}
+		}
+	}
+	return brackets, nil
+}
+
+func (fb *FileBackend) QueryRawValues(uuidBytes uuid.UUID, startTime int64, endTime int64) ([]Point, error) {
+	stream, err := fb.stream(uuidBytes)
+	if err != nil || stream == nil {
+		return []Point{}, err
+	}
+	return stream.pointsIn(startTime, endTime), nil
+}
+
+/** Files are read locally, so there is no load to wait out. */
+func (fb *FileBackend) Busy() bool {
+	return false
+}
+
+func (fb *FileBackend) Close() {
+	fb.lock.Lock()
+	fb.streams = make(map[string]*fileStream)
+	fb.lock.Unlock()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** Returns COUNT points with random values, starting at START and spaced
+	randomly by up to MAXGAP nanoseconds. */
+func randomPoints(rng *rand.Rand, start int64, count int, maxGap int64) []Point {
+	var points []Point = make([]Point, count)
+	var t int64 = start
+	for i := range points {
+		t += 1 + rng.Int63n(maxGap)
+		points[i] = Point{Time: t, Value: rng.Float64() * 100 - 50}
+	}
+	return points
+}
+
+/** Summarizes the points in [FIRST, END) into windows of WIDTH nanoseconds
+	the slow way, for comparison. */
+func bruteForceRecords(points []Point, first int64, width int64, end int64) []StatRecord {
+	var result []StatRecord = make([]StatRecord, 0)
+	for _, point := range points {
+		if point.Time < first || point.Time >= end {
+			continue
+		}
+		var window int64 = first + (point.Time - first) / width * width
+		if len(result) == 0 || result[len(result) - 1].Time != window {
+			result = append(result, StatRecord{Time: window, Min: point.Value, Max: point.Value})
+		}
+		var record *StatRecord = &result[len(result) - 1]
+		record.Min = math.Min(record.Min, point.Value)
+		record.Max = math.Max(record.Max, point.Value)
+		record.Mean += point.Value
+		record.Count++
+	}
+	for i := range result {
+		result[i].Mean /= float64(result[i].Count)
+	}
+	return result
+}
+
+func compareRecords(got []StatRecord, want []StatRecord) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("got %v records, want %v", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].Time != want[i].Time || got[i].Count != want[i].Count || got[i].Min != want[i].Min || got[i].Max != want[i].Max || math.Abs(got[i].Mean - want[i].Mean) > 1e-9 {
+			return fmt.Errorf("record %v: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	return nil
+}
+
+/** Writes the points to UUID.csv in DIR. */
+func writeCSVStream(t *testing.T, dir string, id uuid.UUID, points []Point) {
+	file, err := os.Create(filepath.Join(dir, id.String() + ".csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fmt.Fprintln(file, "time,value")
+	for _, point := range points {
+		fmt.Fprintf(file, "%v,%v\n", point.Time, point.Value)
+	}
+}
+
+func newTestFileBackend(t *testing.T) (Backend, string) {
+	dir, err := ioutil.TempDir("", "filebackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewFileBackend(map[string]interface{}{"db_dir": dir}, "db_", 1, 1)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return backend, dir
+}
+
+func TestSummarizeRecords(t *testing.T) {
+	var records []StatRecord = []StatRecord{
+		{Time: 100, Min: 1, Mean: 1, Max: 1, Count: 1},
+		{Time: 103, Min: 2, Mean: 4, Max: 6, Count: 3},
+		{Time: 112, Min: -1, Mean: 0, Max: 1, Count: 2},
+		{Time: 130, Min: 5, Mean: 5, Max: 5, Count: 1},
+	}
+	var want []StatRecord = []StatRecord{
+		{Time: 100, Min: 1, Mean: 13.0 / 4, Max: 6, Count: 4},
+		{Time: 110, Min: -1, Mean: 0, Max: 1, Count: 2},
+		{Time: 130, Min: 5, Mean: 5, Max: 5, Count: 1},
+	}
+	if err := compareRecords(summarizeRecords(records, 100, 10), want); err != nil {
+		t.Error(err)
+	}
+	if got := summarizeRecords(nil, 0, 10); len(got) != 0 {
+		t.Errorf("summarizing no records gave %v", got)
+	}
+}
+
+func TestBuildIndex(t *testing.T) {
+	var rng *rand.Rand = rand.New(rand.NewSource(1))
+	var points []Point = randomPoints(rng, 1500000000000000000, 5000, 1 << 20)
+	var levels [][]StatRecord = buildIndex(points)
+	if len(levels) == 0 {
+		t.Fatal("no levels were built")
+	}
+	
+	for i, level := range levels {
+		var pw uint8 = FILE_INDEX_FIRST_PW + uint8(i) * FILE_INDEX_STEP
+		var first int64 = (points[0].Time >> pw) << pw
+		var end int64 = (((points[len(points) - 1].Time >> pw) + 1) << pw)
+		if err := compareRecords(level, bruteForceRecords(points, first, int64(1) << pw, end)); err != nil {
+			t.Errorf("level %v (pw %v): %v", i, pw, err)
+		}
+	}
+	if last := levels[len(levels) - 1]; len(last) != 1 {
+		t.Errorf("the coarsest level has %v records, want 1", len(last))
+	}
+	
+	if got := buildIndex(nil); len(got) != 0 {
+		t.Errorf("indexing no points gave %v levels", len(got))
+	}
+}
+
+func TestCoverUsesIndex(t *testing.T) {
+	var rng *rand.Rand = rand.New(rand.NewSource(2))
+	var points []Point = randomPoints(rng, 1500000000000000000, 100000, 1 << 12)
+	var stream *fileStream = &fileStream{points: points, levels: buildIndex(points)}
+	
+	// A window that is not aligned to any level of the index
+	var start int64 = points[100].Time + 12345
+	var end int64 = start + 60000007
+	var records []StatRecord = stream.cover(len(stream.levels) - 1, start, end, nil)
+	var inside int = len(stream.pointsIn(start, end))
+	if len(records) >= inside / 4 {
+		t.Errorf("covering %v points took %v records", inside, len(records))
+	}
+	if err := compareRecords(summarizeRecords(records, start, uint64(end - start)), bruteForceRecords(points, start, end - start, end)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileQueries(t *testing.T) {
+	backend, dir := newTestFileBackend(t)
+	defer os.RemoveAll(dir)
+	
+	var rng *rand.Rand = rand.New(rand.NewSource(3))
+	var points []Point = randomPoints(rng, 1500000000000000000, 20000, 50000000)
+	var id uuid.UUID = uuid.NewRandom()
+	writeCSVStream(t, dir, id, points)
+	
+	var start int64 = points[0].Time + 12345678901
+	var end int64 = points[len(points) - 1].Time - 999
+	for _, pw := range []uint8{10, 16, 20, 27, 36, 50} {
+		got, err := backend.QueryStatisticalValues(id, start, end, pw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var first int64 = (start >> pw) << pw
+		var last int64 = (((end - 1) >> pw) + 1) << pw
+		if err = compareRecords(got, bruteForceRecords(points, first, int64(1) << pw, last)); err != nil {
+			t.Errorf("pw %v: %v", pw, err)
+		}
+	}
+	for _, width := range []int64{1 << 24, 3 << 20, 1000000007, 60000000000} {
+		got, err := backend.QueryWindowValues(id, start, end, uint64(width))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var limit int64 = start + (end - start) / width * width
+		if err = compareRecords(got, bruteForceRecords(points, start, width, limit)); err != nil {
+			t.Errorf("width %v: %v", width, err)
+		}
+	}
+	
+	raw, err := backend.QueryRawValues(id, points[10].Time, points[20].Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 10 || raw[0] != points[10] {
+		t.Errorf("got %v raw points starting with %v, want 10 starting with %v", len(raw), raw[0], points[10])
+	}
+}
+
+func TestFileBrackets(t *testing.T) {
+	backend, dir := newTestFileBackend(t)
+	defer os.RemoveAll(dir)
+	
+	var id uuid.UUID = uuid.NewRandom()
+	var empty uuid.UUID = uuid.NewRandom()
+	var missing uuid.UUID = uuid.NewRandom()
+	writeCSVStream(t, dir, id, []Point{{Time: 1000, Value: 1}, {Time: 2000, Value: 2}, {Time: 5000, Value: 3}})
+	writeCSVStream(t, dir, empty, nil)
+	
+	brackets, err := backend.QueryBrackets([]uuid.UUID{id, empty, missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []Bracket = []Bracket{
+		{Left: 1000, Right: 5000},
+		{Left: INVALID_TIME, Right: INVALID_TIME},
+		{Left: INVALID_TIME, Right: INVALID_TIME},
+	}
+	for i := range want {
+		if brackets[i] != want[i] {
+			t.Errorf("bracket %v: got %+v, want %+v", i, brackets[i], want[i])
+		}
+	}
+}
@@ -36,23 +36,66 @@ DataConn.prototype.send = function(message, callback) {
     }
 }
 
+/** BACKEND is used until the server's configuration has been read from
+    config.json, and if it cannot be read. */
 function Requester(backend) {
     this.backend = backend;
     this.dconnections = [];
-    var i;
-    for (i = 0; i < this.DATA_CONN; i++) {
-        this.dconnections.push(new DataConn("wss://" + backend + "/dataws"));
-    }
     this.bconnections = [];
-    for (i = 0; i < this.BRACK_CONN; i++) {
-    	this.bconnections.push(new DataConn("wss://" + backend + "/bracketws"));
-    }
     this.currDConnection = 0;
     this.currBConnection = 0;
+    var self = this;
+    $.ajax({
+            type: "GET",
+            url: "config.json",
+            dataType: "json",
+            success: function (config) {
+                    self.configure(config);
+                },
+            error: function () {
+                    self.configure({});
+                }
+        });
 }
 
 Requester.prototype.DATA_CONN = 8;
 Requester.prototype.BRACK_CONN = 2;
+Requester.prototype.SECURE = true;
+Requester.prototype.features = {};
+
+/** Applies the configuration served by the backend, and opens the WebSocket
+    connections it recommends. */
+Requester.prototype.configure = function (config) {
+        if (config.backend) {
+            this.backend = config.backend;
+        }
+        if (config.data_connections) {
+            this.DATA_CONN = config.data_connections;
+        }
+        if (config.bracket_connections) {
+            this.BRACK_CONN = config.bracket_connections;
+        }
+        if (config.hasOwnProperty("secure")) {
+            this.SECURE = config.secure;
+        }
+        if (config.features) {
+            this.features = config.features;
+        }
+        
+        var i;
+        for (i = 0; i < this.DATA_CONN; i++) {
+            this.dconnections.push(new DataConn(this.urlFor("ws", "/dataws")));
+        }
+        for (i = 0; i < this.BRACK_CONN; i++) {
+            this.bconnections.push(new DataConn(this.urlFor("ws", "/bracketws")));
+        }
+    };
+
+/** PROTOCOL is "http" or "ws"; the secure variant is used if the backend uses
+    TLS. */
+Requester.prototype.urlFor = function (protocol, path) {
+        return protocol + (this.SECURE ? "s" : "") + "://" + this.backend + path;
+    };
 
 Requester.prototype.makeTagsRequest = function (message, success_callback, type, error_callback) {
         return $.ajax({
@@ -68,7 +111,7 @@ Requester.prototype.makeTagsRequest = function (message, success_callback, type,
 Requester.prototype.makeDataRequest = function (request, success_callback, type, error_callback) {
 		var request_str = request.join(',');
 		if (USE_WEBSOCKETS) {
-			if (!this.dconnections[this.currDConnection].ready) {
+			if (this.dconnections.length == 0 || !this.dconnections[this.currDConnection].ready) {
 		    	var self = this;
 		    	setTimeout(function () { self.makeDataRequest(request, success_callback, type, error_callback); }, 1000);
 		    	return;
@@ -80,7 +123,7 @@ Requester.prototype.makeDataRequest = function (request, success_callback, type,
         } else {
             return $.ajax({
                     type: "POST",
-                    url: "https://" + this.backend + "/data",
+                    url: this.urlFor("http", "/data"),
                     data: request_str,
                     success: success_callback,
                     dataType: type,
@@ -93,7 +136,7 @@ Requester.prototype.makeDataRequest = function (request, success_callback, type,
 Requester.prototype.makeBracketRequest = function (request, success_callback, type, error_callback) {
 		var request_str = request.join(',');
 		if (USE_WEBSOCKETS) {
-		    if (!this.bconnections[this.currBConnection].ready) {
+		    if (this.bconnections.length == 0 || !this.bconnections[this.currBConnection].ready) {
 		    	var self = this;
 		    	setTimeout(function () { self.makeBracketRequest(request, success_callback, type, error_callback); }, 1000);
 		    	return;
@@ -105,7 +148,7 @@ Requester.prototype.makeBracketRequest = function (request, success_callback, ty
         } else {
             return $.ajax({
                     type: "POST",
-                    url: "https://" + this.backend + "/bracket",
+                    url: this.urlFor("http", "/bracket"),
                     data: request_str,
                     success: success_callback,
                     dataType: type,
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** A spanLimit caps the time range of queries at point width PW and finer
+	than the next listed point width. */
+type spanLimit struct {
+	pw uint8
+	span int64
+}
+
+/** QueryLimits bound the work a single request can make us do. A nil
+	QueryLimits only bounds the size of request bodies. */
+type QueryLimits struct {
+	MaxBodySize int64
+	MaxUuids int
+	MaxPoints int64
+	spans []spanLimit // in increasing order of point width
+}
+
+/** The estimated cost of a query. UUIDS is the number of streams named in the
+	request; POINTS is the number of windows we expect to fetch from the
+	database, including the inputs of derived streams and any lookback needed
+	by transforms; SPAN and WIDTH are the time range and window width, in
+	nanoseconds, of each stream queried. */
+type QueryCost struct {
+	Uuids int `json:"uuids"`
+	Points int64 `json:"points"`
+	Span int64 `json:"span"`
+	Width int64 `json:"width,omitempty"`
+}
+
+/** A LimitError describes why a request was refused. It is sent to the client
+	as JSON. */
+type LimitError struct {
+	Message string `json:"error"`
+	Limit string `json:"limit"`
+	Max int64 `json:"max"`
+	Requested int64 `json:"requested"`
+	status int
+}
+
+func (le *LimitError) Error() string {
+	return le.Message
+}
+
+/** Reads the limits from the configuration file: max_body_size in bytes,
+	max_uuids, max_points, and max_span, which is a comma-separated list of
+	point widths and the longest range allowed at that point width and finer,
+	as in "0:1h,10:720h,20:87600h". */
+func LoadQueryLimits(config map[string]interface{}) (*QueryLimits, error) {
+	maxBodySize, err := optionalIntConfig(config, "max_body_size", int(MAX_QUERY_REQUEST_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	maxUuids, err := optionalIntConfig(config, "max_uuids", 1000)
+	if err != nil {
+		return nil, err
+	}
+	maxPoints, err := optionalIntConfig(config, "max_points", 1 << 24)
+	if err != nil {
+		return nil, err
+	}
+	var ql *QueryLimits = &QueryLimits{
+		MaxBodySize: int64(maxBodySize),
+		MaxUuids: maxUuids,
+		MaxPoints: int64(maxPoints),
+	}
+	
+	maxSpan, ok := config["max_span"]
+	if !ok {
+		return ql, nil
+	}
+	for _, entry := range strings.Split(maxSpan.(string), ",") {
+		var parts []string = strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid max_span entry %q: expected pw:duration", entry)
+		}
+		pw, err := strconv.ParseUint(parts[0], 10, 8)
+		if err != nil || pw > 62 {
+			return nil, fmt.Errorf("Invalid point width in max_span entry %q", entry)
+		}
+		span, err := time.ParseDuration(parts[1])
+		if err != nil || span <= 0 {
+			return nil, fmt.Errorf("Invalid duration in max_span entry %q", entry)
+		}
+		ql.spans = append(ql.spans, spanLimit{pw: uint8(pw), span: int64(span)})
+	}
+	sort.Slice(ql.spans, func (i int, j int) bool {
+		return ql.spans[i].pw < ql.spans[j].pw
+	})
+	return ql, nil
+}
+
+/** Estimates the cost of querying STREAMS streams, named by UUIDS streams in
+	the request, in windows of WIDTH nanoseconds over [STARTTIME, ENDTIME). */
+func estimateCost(uuids int, streams int, startTime int64, endTime int64, width int64) QueryCost {
+	var cost QueryCost = QueryCost{Uuids: uuids, Width: width}
+	if endTime <= startTime || width <= 0 {
+		return cost
+	}
+	// Halve both ends separately so that the span can't overflow
+	var span uint64 = uint64((endTime >> 1) - (startTime >> 1)) << 1
+	var windows uint64 = (span + uint64(width) - 1) / uint64(width)
+	cost.Span = int64(span >> 1) << 1
+	if windows > uint64(QUASAR_HIGH) / uint64(streams + 1) {
+		cost.Points = QUASAR_HIGH // more than anyone would allow
+	} else {
+		cost.Points = int64(windows) * int64(streams)
+	}
+	return cost
+}
+
+/** Estimates the cost of a request for data. */
+func (rt *Router) DataRequestCost(req *DataRequest) QueryCost {
+	var streams int = 1
+	if ds := rt.derived.Lookup(req.Uuid); ds != nil {
+		streams = int(ds.Leaves())
+	}
+	var width int64 = req.WindowWidth()
+	if req.Rollup != nil {
+		width = req.Rollup.shortestPeriod()
+	}
+	return estimateCost(1, streams, req.Pipeline.QueryStart(req.StartTime, width), req.EndTime, width)
+}
+
+/** Estimates the cost of a request for the brackets of UUIDS. A derived
+	stream costs as much as the stored streams it is computed from. */
+func (rt *Router) BracketCost(uuids []uuid.UUID) QueryCost {
+	var streams int64 = 0
+	for _, id := range uuids {
+		if ds := rt.derived.Lookup(id); ds != nil {
+			streams += ds.Leaves()
+		} else {
+			streams++
+		}
+	}
+	return QueryCost{Uuids: len(uuids), Points: 2 * streams}
+}
+
+/** Returns an error if the cost exceeds any of the limits, or nil otherwise. */
+func (ql *QueryLimits) Check(cost QueryCost) *LimitError {
+	if ql == nil {
+		return nil
+	}
+	if ql.MaxUuids > 0 && cost.Uuids > ql.MaxUuids {
+		return &LimitError{
+			Message: fmt.Sprintf("A request may name at most %v streams; this one names %v", ql.MaxUuids, cost.Uuids),
+			Limit: "uuids",
+			Max: int64(ql.MaxUuids),
+			Requested: int64(cost.Uuids),
+			status: http.StatusUnprocessableEntity,
+		}
+	}
+	if ql.MaxPoints > 0 && cost.Points > ql.MaxPoints {
+		return &LimitError{
+			Message: fmt.Sprintf("A request may fetch at most %v points; this one would fetch about %v", ql.MaxPoints, cost.Points),
+			Limit: "points",
+			Max: ql.MaxPoints,
+			Requested: cost.Points,
+			status: http.StatusUnprocessableEntity,
+		}
+	}
+	if len(ql.spans) != 0 && cost.Width > 0 {
+		var pw uint8 = pointWidthForStep(cost.Width)
+		var limit spanLimit = ql.spans[0]
+		for _, candidate := range ql.spans {
+			if candidate.pw <= pw {
+				limit = candidate
+			}
+		}
+		if cost.Span > limit.span {
+			return &LimitError{
+				Message: fmt.Sprintf("At point width %v, a request may span at most %v; this one spans %v", pw, time.Duration(limit.span), time.Duration(cost.Span)),
+				Limit: "span",
+				Max: limit.span,
+				Requested: cost.Span,
+				status: http.StatusUnprocessableEntity,
+			}
+		}
+	}
+	return nil
+}
+
+/** Decides whether to serve an HTTP request of the specified cost. If the
+	request is a dry run, with the dry_run query parameter set, the estimated
+	cost and whether the request would be served are written to the response;
+	if the request exceeds the limits, the error is. In either case, returns
+	false. */
+func (ql *QueryLimits) Admit(w http.ResponseWriter, r *http.Request, cost QueryCost) bool {
+	var lerr *LimitError = ql.Check(cost)
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cost": cost,
+			"allowed": lerr == nil,
+			"rejection": lerr,
+		})
+		return false
+	}
+	if lerr != nil {
+		writeJSON(w, lerr.status, lerr)
+		return false
+	}
+	return true
+}
+
+/** Writes a LimitError to a Writable, for requests that arrive on a
+	WebSocket. */
+func writeLimitError(lerr *LimitError, writ Writable) {
+	body, err := json.Marshal(lerr)
+	if err != nil {
+		body = []byte(lerr.Message)
+	}
+	w := writ.GetWriter()
+	w.Write(body)
+}
+
+/** Reads the body of a request, up to the maximum size. If it is too large or
+	can't be read, writes an error to the response and returns false. */
+func (ql *QueryLimits) ReadBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var maxSize int64 = MAX_QUERY_REQUEST_SIZE
+	if ql != nil && ql.MaxBodySize > 0 {
+		maxSize = ql.MaxBodySize
+	}
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err == nil {
+		return payload, true
+	}
+	if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+		writeJSON(w, http.StatusRequestEntityTooLarge, &LimitError{
+			Message: fmt.Sprintf("Request bodies may be at most %v bytes", maxSize),
+			Limit: "body_size",
+			Max: maxSize,
+			Requested: r.ContentLength,
+		})
+		return nil, false
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+	return nil, false
+}
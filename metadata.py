@@ -99,6 +99,15 @@ class HTTPRequestHandler(BaseHTTPRequestHandler):
             for stream in streams:
                 returnstr += stream + ", "
             self.wfile.write(returnstr[:-2] + ']')
+        elif self.query.startswith('select * where Path like'): # '%' matches any sequence of characters
+            pattern = self.query.split('"')[1]
+            regex = '^' + '.*'.join(map(re.escape, pattern.split('%'))) + '$'
+            streams = []
+            for stream in mongo_collection.find({'Path': {'$regex': regex}}):
+                if not pathstarts or doc_matches_path(stream, pathstarts):
+                    del stream['_id']
+                    streams.append(stream)
+            self.wfile.write(json.dumps(streams))
         else:
             self.wfile.write('[]')
                     
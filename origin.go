@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	
+	ws "github.com/gorilla/websocket"
+)
+
+/** An OriginPolicy lists the origins, besides the server's own, from which
+	browsers may open WebSockets and make cross-origin requests. A nil
+	OriginPolicy admits only the server's own origin. */
+type OriginPolicy struct {
+	allowed map[string]bool
+	any bool
+}
+
+/** Parses a comma-separated list of origins, such as
+	"https://plotter.example.com,https://localhost:8080". An origin of "*"
+	allows every origin, but only to make requests without credentials; the
+	origins listed explicitly may also use the token cookie. */
+func NewOriginPolicy(origins string) *OriginPolicy {
+	var op *OriginPolicy = &OriginPolicy{allowed: make(map[string]bool)}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimRight(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin == "*" {
+			op.any = true
+		} else if origin != "" {
+			op.allowed[origin] = true
+		}
+	}
+	return op
+}
+
+/** Returns true if the request may be served given its Origin header.
+	Requests without an Origin header don't come from a browser script, and
+	are always allowed, as are requests from the server's own origin. */
+func (op *OriginPolicy) Allows(r *http.Request) bool {
+	return op.listed(r) || op != nil && op.any
+}
+
+/** Returns true if the request comes from an origin trusted with the user's
+	credentials: it has no Origin header, or comes from the server's own
+	origin or one listed explicitly. Origins admitted only by "*" are not. */
+func (op *OriginPolicy) listed(r *http.Request) bool {
+	var origin string = r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	return op != nil && op.allowed[strings.ToLower(origin)]
+}
+
+/** Applies the policy to WebSocket upgrades. Browsers send cookies with
+	WebSocket handshakes from any origin, so origins admitted only by "*" may
+	not open WebSockets that carry the token cookie. */
+func (op *OriginPolicy) ConfigureUpgrader(upgrader *ws.Upgrader) {
+	upgrader.CheckOrigin = func (r *http.Request) bool {
+		if op.listed(r) {
+			return true
+		}
+		_, err := r.Cookie(TOKEN_COOKIE)
+		return op.Allows(r) && err != nil
+	}
+}
+
+/** Wraps a handler so that it answers CORS preflight requests and marks its
+	responses as readable by the allowed origins. Requests from other origins
+	are refused. Requests from origins admitted only by "*" are served as if
+	they carried no cookies, and their responses can't be read by scripts
+	that sent credentials. */
+func (op *OriginPolicy) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		var origin string = r.Header.Get("Origin")
+		if !op.Allows(r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Requests from origin " + origin + " are not allowed."))
+			return
+		}
+		if !op.listed(r) {
+			r.Header.Del("Cookie")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, " + CSRF_HEADER)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
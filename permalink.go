@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** The largest plot state, in bytes, that we accept. */
+const MAX_STATE_SIZE int64 = 1 << 20
+
+/** The longest lifetime, in seconds, that a client may request for a
+	permalink. */
+const MAX_PERMALINK_LIFETIME int64 = 10 * 365 * 24 * 60 * 60
+
+const PERMALINK_ID_LENGTH int = 8
+const PERMALINK_ID_CHARS string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+/** The state of a stream in a plot. COLOR holds the red, green and blue
+	components, each between 0 and 1. AXIS is the ID of the axis the stream
+	is plotted against. */
+type StreamState struct {
+	Uuid string `json:"uuid"`
+	Color [3]float64 `json:"color"`
+	Axis string `json:"axis"`
+	Selected bool `json:"selected,omitempty"`
+}
+
+/** The state of a y-axis in a plot. An axis without a DOMAIN is scaled
+	automatically. */
+type AxisState struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	Domain *[2]float64 `json:"domain,omitempty"`
+	Right bool `json:"right,omitempty"`
+}
+
+/** Everything needed to reproduce a plot. START and END delimit the time
+	window, in nanoseconds. */
+type PlotState struct {
+	Streams []StreamState `json:"streams"`
+	Axes []AxisState `json:"axes"`
+	Start int64 `json:"start"`
+	End int64 `json:"end"`
+}
+
+/** Checks that the plot state is internally consistent. */
+func (ps *PlotState) Validate() error {
+	if ps.Start < QUASAR_LOW || ps.End > QUASAR_HIGH || ps.Start >= ps.End {
+		return fmt.Errorf("Invalid time window [%v, %v]", ps.Start, ps.End)
+	}
+	if len(ps.Axes) == 0 {
+		return fmt.Errorf("At least one axis is required")
+	}
+	
+	var axisIDs map[string]bool = make(map[string]bool)
+	for _, axis := range ps.Axes {
+		if axis.ID == "" {
+			return fmt.Errorf("Every axis must have an ID")
+		}
+		if axisIDs[axis.ID] {
+			return fmt.Errorf("Axis ID %v is used more than once", axis.ID)
+		}
+		axisIDs[axis.ID] = true
+		if axis.Domain != nil && !(axis.Domain[0] < axis.Domain[1]) {
+			return fmt.Errorf("Axis %v has invalid domain [%v, %v]", axis.ID, axis.Domain[0], axis.Domain[1])
+		}
+	}
+	
+	var streams map[string]bool = make(map[string]bool)
+	for _, stream := range ps.Streams {
+		var parsed uuid.UUID = uuid.Parse(stream.Uuid)
+		if parsed == nil {
+			return fmt.Errorf("Invalid UUID %v", stream.Uuid)
+		}
+		if streams[parsed.String()] {
+			return fmt.Errorf("Stream %v appears more than once", stream.Uuid)
+		}
+		streams[parsed.String()] = true
+		if !axisIDs[stream.Axis] {
+			return fmt.Errorf("Stream %v is assigned to nonexistent axis %v", stream.Uuid, stream.Axis)
+		}
+		for _, component := range stream.Color {
+			if component < 0 || component > 1 {
+				return fmt.Errorf("Stream %v has invalid color %v", stream.Uuid, stream.Color)
+			}
+		}
+	}
+	
+	return nil
+}
+
+/** A stored plot state. */
+type Permalink struct {
+	ID string `json:"id"`
+	State *PlotState `json:"state"`
+	Created time.Time `json:"created"`
+	Owner string `json:"owner,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+/** The body of a request to create a permalink. EXPIRESIN is the lifetime of
+	the permalink in seconds; if it is zero, the permalink never expires. */
+type permalinkRequest struct {
+	State *PlotState `json:"state"`
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+/** Returned when a client creates a permalink once the service holds as
+	many as it may. */
+var errPermalinksFull error = fmt.Errorf("Too many permalinks have been created")
+
+/** A PermalinkService stores plot states under short IDs. It serves POST
+	requests to /permalink, which create a permalink, and GET requests to
+	/permalink/ID, which return one. It stores at most a fixed number of
+	permalinks; expired ones are removed to make room. */
+type PermalinkService struct {
+	store *DiskStore
+	auth *Authenticator
+	lock *sync.Mutex
+	stored int
+	maxStored int
+}
+
+/** Creates a service that keeps up to MAXSTORED permalinks in STORE. The
+	permalinks already in STORE count toward the limit. */
+func NewPermalinkService(store *DiskStore, auth *Authenticator, maxStored int) (*PermalinkService, error) {
+	var ps *PermalinkService = &PermalinkService{
+		store: store,
+		auth: auth,
+		lock: &sync.Mutex{},
+		maxStored: maxStored,
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	err := ps.purgeExpired()
+	if err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+/** Deletes the expired permalinks in the store and recounts the rest. The
+	caller must hold the lock. */
+func (ps *PermalinkService) purgeExpired() error {
+	keys, err := ps.store.Keys()
+	if err != nil {
+		return err
+	}
+	var now time.Time = time.Now()
+	ps.stored = 0
+	for _, key := range keys {
+		var link Permalink
+		found, err := ps.store.Get(key, &link)
+		if err != nil {
+			return fmt.Errorf("%v: %v", key, err)
+		}
+		if !found {
+			continue
+		}
+		if link.Expires != nil && now.After(*link.Expires) {
+			err = ps.store.Delete(key)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		ps.stored++
+	}
+	return nil
+}
+
+/** Stores the specified state, which must already be valid, and returns the
+	new permalink. Returns errPermalinksFull if no more permalinks may be
+	stored. */
+func (ps *PermalinkService) Create(state *PlotState, owner string, lifetime time.Duration) (*Permalink, error) {
+	var link *Permalink = &Permalink{
+		State: state,
+		Created: time.Now().UTC(),
+		Owner: owner,
+	}
+	if lifetime > 0 {
+		var expires time.Time = link.Created.Add(lifetime)
+		link.Expires = &expires
+	}
+	
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if ps.stored >= ps.maxStored {
+		err := ps.purgeExpired()
+		if err != nil {
+			return nil, err
+		}
+		if ps.stored >= ps.maxStored {
+			return nil, errPermalinksFull
+		}
+	}
+	
+	for attempt := 0; attempt < 10; attempt++ {
+		id, err := randomID(PERMALINK_ID_LENGTH)
+		if err != nil {
+			return nil, err
+		}
+		link.ID = id
+		stored, err := ps.store.PutNew(link.ID, link)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			ps.stored++
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find an unused permalink ID")
+}
+
+/** Returns the permalink with the specified ID, or nil if there is no such
+	permalink or it has expired. */
+func (ps *PermalinkService) Get(id string) (*Permalink, error) {
+	var link Permalink
+	found, err := ps.store.Get(id, &link)
+	if err != nil || !found {
+		return nil, err
+	}
+	if link.Expires != nil && time.Now().After(*link.Expires) {
+		ps.expire(id)
+		return nil, nil
+	}
+	return &link, nil
+}
+
+/** Deletes the expired permalink with the specified ID, unless another
+	request already has. */
+func (ps *PermalinkService) expire(id string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	found, err := ps.store.Get(id, &Permalink{})
+	if err != nil || !found {
+		return
+	}
+	if ps.store.Delete(id) == nil {
+		ps.stored--
+	}
+}
+
+func (ps *PermalinkService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var id string = strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/permalink"), "/")
+	
+	if r.Method == "GET" && id != "" {
+		if !isValidKey(id) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("No permalink with ID %v", id)))
+			return
+		}
+		link, err := ps.Get(id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("Could not read permalink: %v", err)))
+			return
+		}
+		if link == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("No permalink with ID %v", id)))
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+		return
+	}
+	
+	if r.Method != "POST" || id != "" {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("You must POST a plot state to /permalink, or GET /permalink/ID."))
+		return
+	}
+	
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_STATE_SIZE + 1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+		return
+	}
+	if int64(len(payload)) > MAX_STATE_SIZE {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("Plot state may be at most %v bytes", MAX_STATE_SIZE)))
+		return
+	}
+	
+	var req permalinkRequest
+	err = json.Unmarshal(payload, &req)
+	if err == nil && req.State == nil {
+		err = fmt.Errorf("missing \"state\"")
+	}
+	if err == nil && (req.ExpiresIn < 0 || req.ExpiresIn > MAX_PERMALINK_LIFETIME) {
+		err = fmt.Errorf("\"expires_in\" must be between 0 and %v", MAX_PERMALINK_LIFETIME)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid permalink request: %v", err)))
+		return
+	}
+	
+	var owner string = principalName(ps.auth.Authenticate(r))
+	if err = req.State.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid plot state: %v", err)))
+		return
+	}
+	
+	link, err := ps.Create(req.State, owner, time.Duration(req.ExpiresIn) * time.Second)
+	if err == errPermalinksFull {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Could not store permalink: %v", err)))
+		return
+	}
+	
+	writeJSON(w, http.StatusCreated, link)
+}
+
+/** Generates a random ID of the specified length. */
+func randomID(length int) (string, error) {
+	var raw []byte = make([]byte, length)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	var id []byte = make([]byte, length)
+	for i, b := range raw {
+		id[i] = PERMALINK_ID_CHARS[int(b) % len(PERMALINK_ID_CHARS)]
+	}
+	return string(id), nil
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	
+	quasar "github.com/SoftwareDefinedBuildings/webgl-plotter/quasar"
+	ws "github.com/gorilla/websocket"
+)
+
+/** A statistical record, as printed with -json. */
+type record struct {
+	Time int64 `json:"time"`
+	Min float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	Max float64 `json:"max"`
+	Count uint64 `json:"count"`
+}
+
+/** Joins the millisecond and nanosecond parts in which the server sends
+	times. */
+func joinTime(millis json.Number, nanos json.Number) (int64, error) {
+	ms, err := millis.Int64()
+	if err != nil {
+		return 0, err
+	}
+	ns, err := nanos.Int64()
+	if err != nil {
+		return 0, err
+	}
+	return ms * 1000000 + ns, nil
+}
+
+/** Returns true if a time sent by the server marks a boundary it could not
+	determine. The server splits INVALID_TIME in a way that joinTime doesn't
+	undo, so we compare the parts as sent. */
+func isInvalidTime(millis json.Number, nanos json.Number) bool {
+	invalidMillis, invalidNanos := quasar.SplitTime(quasar.INVALID_TIME)
+	return millis.String() == strconv.FormatInt(invalidMillis, 10) && nanos.String() == strconv.FormatInt(int64(invalidNanos), 10)
+}
+
+/** Decodes a response to a data request: an array of [millis, nanos, min,
+	mean, max, count] arrays, wrapped in an object with the point width if
+	the server chose it. Returns the point width, or -1 if the server didn't
+	say. */
+func decodeRecords(body []byte) ([]record, int, error) {
+	var decoder *json.Decoder = json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var raw [][]json.Number
+	var pw int = -1
+	
+	if trimmed := bytes.TrimSpace(body); len(trimmed) != 0 && trimmed[0] == '{' {
+		var wrapped struct {
+			Pw int `json:"pw"`
+			Data [][]json.Number `json:"data"`
+		}
+		if err := decoder.Decode(&wrapped); err != nil {
+			return nil, 0, fmt.Errorf("Could not decode response: %v", err)
+		}
+		raw, pw = wrapped.Data, wrapped.Pw
+	} else if len(trimmed) != 0 && trimmed[0] == '[' {
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, 0, fmt.Errorf("Could not decode response: %v", err)
+		}
+	} else {
+		// Errors in the middle of the protocol are sent as plain text
+		return nil, 0, fmt.Errorf("%v", serverError(body))
+	}
+	
+	var records []record = make([]record, len(raw))
+	for i, fields := range raw {
+		if len(fields) != 6 {
+			return nil, 0, fmt.Errorf("Malformed record %v", fields)
+		}
+		var err error
+		records[i].Time, err = joinTime(fields[0], fields[1])
+		if err == nil {
+			records[i].Min, err = fields[2].Float64()
+		}
+		if err == nil {
+			records[i].Mean, err = fields[3].Float64()
+		}
+		if err == nil {
+			records[i].Max, err = fields[4].Float64()
+		}
+		if err == nil {
+			records[i].Count, err = strconv.ParseUint(fields[5].String(), 10, 64)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("Malformed record %v: %v", fields, err)
+		}
+	}
+	return records, pw, nil
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+func printRecords(records []record, header bool) {
+	var table *tabwriter.Writer = newTable()
+	if header {
+		fmt.Fprintln(table, "TIME\tMIN\tMEAN\tMAX\tCOUNT")
+	}
+	for _, r := range records {
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\n", formatTime(r.Time), r.Min, r.Mean, r.Max, r.Count)
+	}
+	table.Flush()
+}
+
+/** The flags of a command that takes a stream and a time range. */
+type streamFlags struct {
+	*flag.FlagSet
+	client *client
+	start *string
+	end *string
+	pw *string
+}
+
+func newStreamFlags(name string, defaultStart string, defaultPw string) *streamFlags {
+	var sf *streamFlags = &streamFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError), client: &client{}}
+	sf.client.addFlags(sf.FlagSet)
+	sf.start = sf.String("start", defaultStart, "the start of the time range")
+	sf.end = sf.String("end", "now", "the end of the time range")
+	sf.pw = sf.String("pw", defaultPw, "a point width, a window such as \"15m\", a period such as \"day@UTC\", or a budget such as \"800px\" or \"500pts\"")
+	sf.Usage = func () {
+		fmt.Fprintf(os.Stderr, "Usage: plotterctl %v [FLAGS] UUID\n", name)
+		sf.PrintDefaults()
+	}
+	return sf
+}
+
+/** Parses ARGS and returns the stream and the time range. */
+func (sf *streamFlags) parse(args []string) (string, int64, int64, error) {
+	sf.Parse(args)
+	if sf.NArg() != 1 {
+		sf.Usage()
+		os.Exit(2)
+	}
+	sf.client.init()
+	startTime, endTime, err := parseRange(*sf.start, *sf.end)
+	return sf.Arg(0), startTime, endTime, err
+}
+
+func dataCommand(args []string) error {
+	var sf *streamFlags = newStreamFlags("data", "now-1h", "1000pts")
+	uuidStr, startTime, endTime, err := sf.parse(args)
+	if err != nil {
+		return err
+	}
+	var c *client = sf.client
+	body, err := c.fetch("POST", "/data", nil, fmt.Sprintf("%v,%v,%v,%v", uuidStr, startTime, endTime, *sf.pw))
+	if err != nil {
+		return err
+	}
+	records, chosen, err := decodeRecords(body)
+	if err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		return printJSON(records)
+	}
+	if chosen >= 0 {
+		fmt.Fprintf(os.Stderr, "Point width %v (windows of %v)\n", chosen, time.Duration(int64(1) << uint(chosen)))
+	}
+	printRecords(records, true)
+	return nil
+}
+
+func bracketCommand(args []string) error {
+	var c *client = &client{}
+	var fs *flag.FlagSet = flag.NewFlagSet("bracket", flag.ExitOnError)
+	c.addFlags(fs)
+	fs.Usage = func () {
+		fmt.Fprintln(os.Stderr, "Usage: plotterctl bracket [FLAGS] UUID...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c.init()
+	
+	body, err := c.fetch("POST", "/bracket", nil, strings.Join(fs.Args(), ","))
+	if err != nil {
+		return err
+	}
+	var decoder *json.Decoder = json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var raw map[string][2][2]json.Number
+	if err = decoder.Decode(&raw); err != nil {
+		return fmt.Errorf("%v", serverError(body))
+	}
+	
+	type bracket struct {
+		Uuid string `json:"uuid"`
+		First *int64 `json:"first"`
+		Last *int64 `json:"last"`
+	}
+	var brackets []bracket = make([]bracket, 0, len(raw))
+	for _, uuidStr := range append(fs.Args(), "Merged") {
+		boundaries, ok := raw[strings.ToLower(uuidStr)]
+		if !ok {
+			boundaries, ok = raw[uuidStr]
+		}
+		if !ok {
+			continue
+		}
+		var b bracket = bracket{Uuid: uuidStr}
+		first, err := joinTime(boundaries[0][0], boundaries[0][1])
+		if err == nil && !isInvalidTime(boundaries[0][0], boundaries[0][1]) {
+			b.First = &first
+		}
+		last, err := joinTime(boundaries[1][0], boundaries[1][1])
+		if err == nil && !isInvalidTime(boundaries[1][0], boundaries[1][1]) {
+			b.Last = &last
+		}
+		brackets = append(brackets, b)
+	}
+	
+	if c.jsonOutput {
+		return printJSON(brackets)
+	}
+	var table *tabwriter.Writer = newTable()
+	fmt.Fprintln(table, "UUID\tFIRST\tLAST")
+	for _, b := range brackets {
+		var first, last string = "-", "-"
+		if b.First != nil {
+			first = formatTime(*b.First)
+		}
+		if b.Last != nil {
+			last = formatTime(*b.Last)
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\n", b.Uuid, first, last)
+	}
+	table.Flush()
+	return nil
+}
+
+func metadataCommand(args []string) error {
+	var c *client = &client{}
+	var fs *flag.FlagSet = flag.NewFlagSet("metadata", flag.ExitOnError)
+	c.addFlags(fs)
+	fs.Usage = func () {
+		fmt.Fprintln(os.Stderr, "Usage: plotterctl metadata [FLAGS] QUERY")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c.init()
+	
+	body, err := c.fetch("POST", "/metadata", nil, strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+	var docs []map[string]interface{}
+	if c.jsonOutput || json.Unmarshal(body, &docs) != nil {
+		var v interface{}
+		if json.Unmarshal(body, &v) != nil {
+			os.Stdout.Write(body) // not JSON; show whatever the server said
+			return nil
+		}
+		return printJSON(v)
+	}
+	
+	var table *tabwriter.Writer = newTable()
+	fmt.Fprintln(table, "UUID\tPATH")
+	for _, doc := range docs {
+		fmt.Fprintf(table, "%v\t%v\n", doc["uuid"], doc["Path"])
+	}
+	table.Flush()
+	return nil
+}
+
+func exportCommand(args []string) error {
+	var sf *streamFlags = newStreamFlags("export", "now-1d", "1000pts")
+	var output *string = sf.String("o", "", "the file to write, instead of standard output")
+	uuidStr, startTime, endTime, err := sf.parse(args)
+	if err != nil {
+		return err
+	}
+	var c *client = sf.client
+	var query url.Values = url.Values{}
+	query.Set("uuid", uuidStr)
+	query.Set("start", strconv.FormatInt(startTime, 10))
+	query.Set("end", strconv.FormatInt(endTime, 10))
+	query.Set("pw", *sf.pw)
+	resp, err := c.do("GET", "/export", query, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+/** Queries the server over a WebSocket, as the plotter does. */
+type socketClient struct {
+	conn *ws.Conn
+	tag uint64
+}
+
+func (c *client) dialData() (*socketClient, error) {
+	var target string = "ws" + strings.TrimPrefix(c.server, "http") + "/dataws"
+	var header http.Header = http.Header{}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer " + c.token)
+	}
+	var dialer ws.Dialer = ws.Dialer{HandshakeTimeout: 30 * time.Second, EnableCompression: true}
+	if c.insecure {
+		dialer.TLSClientConfig = c.http.Transport.(*http.Transport).TLSClientConfig
+	}
+	conn, resp, err := dialer.Dial(target, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("Could not open WebSocket: %v", resp.Status)
+		}
+		return nil, fmt.Errorf("Could not open WebSocket: %v", err)
+	}
+	return &socketClient{conn: conn}, nil
+}
+
+/** Sends a data request and waits for the response and the echoed tag. */
+func (sc *socketClient) query(request string) ([]byte, error) {
+	sc.tag++
+	var tag string = strconv.FormatUint(sc.tag, 10)
+	err := sc.conn.WriteMessage(ws.TextMessage, []byte(request + "," + tag))
+	if err != nil {
+		return nil, err
+	}
+	_, response, err := sc.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	_, echoed, err := sc.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if string(echoed) != tag {
+		return nil, fmt.Errorf("Expected tag %v, got %q", tag, echoed)
+	}
+	return response, nil
+}
+
+func watchCommand(args []string) error {
+	var sf *streamFlags = newStreamFlags("watch", "now-5m", "30")
+	var interval *time.Duration = sf.Duration("interval", 5 * time.Second, "how often to check for new data")
+	uuidStr, startTime, _, err := sf.parse(args)
+	if err != nil {
+		return err
+	}
+	var c *client = sf.client
+	pw, err := strconv.ParseUint(*sf.pw, 10, 8)
+	if err != nil || pw > 62 {
+		return fmt.Errorf("watch needs a numeric point width; got %q", *sf.pw)
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("The interval must be positive")
+	}
+	var width int64 = int64(1) << pw
+	
+	sc, err := c.dialData()
+	if err != nil {
+		return err
+	}
+	defer sc.conn.Close()
+	
+	// Only print windows that have ended, since later data would change them
+	var printed int64 = startTime - width
+	var first bool = true
+	for {
+		var now int64 = time.Now().UnixNano()
+		var complete int64 = ((now >> pw) << pw) - width
+		if complete > printed {
+			response, err := sc.query(fmt.Sprintf("%v,%v,%v,%v", uuidStr, printed + width, complete, pw))
+			if err != nil {
+				return err
+			}
+			records, _, err := decodeRecords(response)
+			if err != nil {
+				return err
+			}
+			var fresh []record = make([]record, 0, len(records))
+			for _, r := range records {
+				if r.Time > printed && r.Time <= complete {
+					fresh = append(fresh, r)
+				}
+			}
+			if c.jsonOutput {
+				var encoder *json.Encoder = json.NewEncoder(os.Stdout)
+				for _, r := range fresh {
+					encoder.Encode(r)
+				}
+			} else {
+				printRecords(fresh, first)
+				first = false
+			}
+			printed = complete
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func permalinkCommand(args []string) error {
+	var c *client = &client{}
+	var fs *flag.FlagSet = flag.NewFlagSet("permalink", flag.ExitOnError)
+	c.addFlags(fs)
+	fs.Usage = func () {
+		fmt.Fprintln(os.Stderr, "Usage: plotterctl permalink get [FLAGS] ID")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "get" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c.init()
+	
+	body, err := c.fetch("GET", "/permalink/" + url.PathEscape(fs.Arg(0)), nil, "")
+	if err != nil {
+		return err
+	}
+	var link struct {
+		ID string `json:"id"`
+		Created time.Time `json:"created"`
+		Owner string `json:"owner"`
+		Expires *time.Time `json:"expires"`
+		State struct {
+			Start int64 `json:"start"`
+			End int64 `json:"end"`
+			Streams []struct {
+				Uuid string `json:"uuid"`
+				Axis string `json:"axis"`
+				Color [3]float64 `json:"color"`
+			} `json:"streams"`
+		} `json:"state"`
+	}
+	if err = json.Unmarshal(body, &link); err != nil {
+		return fmt.Errorf("Could not decode permalink: %v", err)
+	}
+	if c.jsonOutput {
+		var v interface{}
+		json.Unmarshal(body, &v)
+		return printJSON(v)
+	}
+	
+	fmt.Printf("ID:      %v\n", link.ID)
+	fmt.Printf("Created: %v\n", link.Created.Local().Format(time.RFC3339))
+	if link.Owner != "" {
+		fmt.Printf("Owner:   %v\n", link.Owner)
+	}
+	if link.Expires != nil {
+		fmt.Printf("Expires: %v\n", link.Expires.Local().Format(time.RFC3339))
+	}
+	fmt.Printf("Range:   %v to %v\n\n", formatTime(link.State.Start), formatTime(link.State.End))
+	var table *tabwriter.Writer = newTable()
+	fmt.Fprintln(table, "UUID\tAXIS\tCOLOR")
+	for _, stream := range link.State.Streams {
+		fmt.Fprintf(table, "%v\t%v\t#%02x%02x%02x\n", stream.Uuid, stream.Axis,
+			int(stream.Color[0] * 255), int(stream.Color[1] * 255), int(stream.Color[2] * 255))
+	}
+	table.Flush()
+	return nil
+}
@@ -0,0 +1,166 @@
+/** plotterctl queries a plotter server from the command line.
+
+	Usage: plotterctl COMMAND [FLAGS] ARGS
+	
+	The server and token are taken from the -server and -token flags, or from
+	the PLOTTER_SERVER and PLOTTER_TOKEN environment variables. Run a command
+	with -h for its flags. */
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const DEFAULT_SERVER string = "https://localhost:8080"
+
+const USAGE string = `Usage: plotterctl COMMAND [FLAGS] ARGS
+
+Commands:
+	data UUID             statistical data for a stream
+	bracket UUID...       the first and last points of streams
+	metadata QUERY        run a metadata query, such as "select * where Path like \"/upmu/%\""
+	export UUID           data for a stream as CSV
+	watch UUID            print new data for a stream as it arrives
+	permalink get ID      show a saved plot
+
+Times may be given as "now", "now-6h", "-2d", "today", "yesterday",
+"2026-10-19", "2026-10-19 08:00", an RFC 3339 time, or nanoseconds since the
+epoch. Durations may use the units d (days) and w (weeks).
+`
+
+/** The connection to the server, and the flags that every command accepts. */
+type client struct {
+	server string
+	token string
+	jsonOutput bool
+	insecure bool
+	http *http.Client
+}
+
+/** Registers the common flags on FS. */
+func (c *client) addFlags(fs *flag.FlagSet) {
+	var server string = os.Getenv("PLOTTER_SERVER")
+	if server == "" {
+		server = DEFAULT_SERVER
+	}
+	fs.StringVar(&c.server, "server", server, "the base URL of the plotter server")
+	fs.StringVar(&c.token, "token", os.Getenv("PLOTTER_TOKEN"), "the token with which to authenticate")
+	fs.BoolVar(&c.jsonOutput, "json", false, "print JSON instead of a table")
+	fs.BoolVar(&c.insecure, "insecure", false, "don't verify the server's TLS certificate")
+}
+
+/** Finishes setting up the client once the flags have been parsed. */
+func (c *client) init() {
+	c.server = strings.TrimRight(c.server, "/")
+	if !strings.Contains(c.server, "://") {
+		c.server = "https://" + c.server
+	}
+	var transport *http.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	if c.insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	c.http = &http.Client{Transport: transport, Timeout: 5 * time.Minute}
+}
+
+/** Makes a request to the server and returns the response if its status is
+	200; otherwise, returns the error the server sent. The caller must close
+	the body of the response. */
+func (c *client) do(method string, path string, query url.Values, body string) (*http.Response, error) {
+	var target string = c.server + path
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer " + c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64 * 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v: %v", resp.Status, serverError(message))
+	}
+	return resp, nil
+}
+
+/** Like do, but reads the whole body. */
+func (c *client) fetch(method string, path string, query url.Values, body string) ([]byte, error) {
+	resp, err := c.do(method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+/** Extracts the message from an error the server sent, which is either plain
+	text or a JSON object with an "error" field. */
+func serverError(body []byte) string {
+	var structured struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &structured) == nil && structured.Error != "" {
+		return structured.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+/** Prints V as indented JSON. */
+func printJSON(v interface{}) error {
+	encoded, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(append(encoded, '\n'))
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, USAGE)
+		os.Exit(2)
+	}
+	
+	var commands map[string]func (args []string) error = map[string]func (args []string) error{
+		"data": dataCommand,
+		"bracket": bracketCommand,
+		"metadata": metadataCommand,
+		"export": exportCommand,
+		"watch": watchCommand,
+		"permalink": permalinkCommand,
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "help" && os.Args[1] != "-h" && os.Args[1] != "--help" {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", os.Args[1])
+		}
+		fmt.Fprint(os.Stderr, USAGE)
+		os.Exit(2)
+	}
+	
+	err := command(os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "plotterctl %v: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/** Matches a number of days or weeks in a duration. */
+var longUnit *regexp.Regexp = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?)([dw])`)
+
+/** The layouts accepted for absolute times, in the local time zone unless
+	they give one. */
+var timeLayouts []string = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+/** Parses a duration, which may use the units d and w as well as those
+	understood by time.ParseDuration. */
+func parseDuration(s string) (time.Duration, error) {
+	s = longUnit.ReplaceAllStringFunc(s, func (match string) string {
+		var parts []string = longUnit.FindStringSubmatch(match)
+		value, _ := strconv.ParseFloat(parts[1], 64)
+		var hours float64 = value * 24
+		if parts[2] == "w" {
+			hours *= 7
+		}
+		return strconv.FormatFloat(hours, 'f', -1, 64) + "h"
+	})
+	return time.ParseDuration(s)
+}
+
+/** Parses a human-friendly time, relative to NOW where that applies, and
+	returns it in nanoseconds since the epoch. */
+func parseTime(s string, now time.Time) (int64, error) {
+	s = strings.TrimSpace(s)
+	var midnight time.Time = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	
+	var base time.Time
+	var offset string
+	switch {
+	case strings.HasPrefix(s, "now"):
+		base, offset = now, s[len("now"):]
+	case strings.HasPrefix(s, "today"):
+		base, offset = midnight, s[len("today"):]
+	case strings.HasPrefix(s, "yesterday"):
+		base, offset = midnight.AddDate(0, 0, -1), s[len("yesterday"):]
+	case strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+"):
+		base, offset = now, s
+	default:
+		if nanos, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) > len("20061231") {
+			return nanos, nil
+		}
+		for _, layout := range timeLayouts {
+			t, err := time.ParseInLocation(layout, s, now.Location())
+			if err == nil {
+				return t.UnixNano(), nil
+			}
+		}
+		return 0, fmt.Errorf("Could not interpret %q as a time", s)
+	}
+	
+	if offset == "" {
+		return base.UnixNano(), nil
+	}
+	if offset[0] != '-' && offset[0] != '+' {
+		return 0, fmt.Errorf("Could not interpret %q as a time", s)
+	}
+	d, err := parseDuration(offset[1:])
+	if err != nil {
+		return 0, fmt.Errorf("Could not interpret %q as a time: %v", s, err)
+	}
+	if offset[0] == '-' {
+		d = -d
+	}
+	return base.Add(d).UnixNano(), nil
+}
+
+/** Parses the start and end of a time range. */
+func parseRange(start string, end string) (int64, int64, error) {
+	var now time.Time = time.Now()
+	startTime, err := parseTime(start, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	endTime, err := parseTime(end, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if startTime >= endTime {
+		return 0, 0, fmt.Errorf("The start of the range must come before its end")
+	}
+	return startTime, endTime, nil
+}
+
+/** Formats a time in nanoseconds for a table. */
+func formatTime(nanos int64) string {
+	return time.Unix(0, nanos).Format("2006-01-02 15:04:05.000000000 MST")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** The most windows we prefetch at any one point width. */
+const PREFETCH_MAX_WINDOWS int64 = 1 << 16
+
+/** The most prefetched ranges we remember for each stream and point width. */
+const PREFETCH_MAX_SPANS int = 8
+
+/** How long a prefetch may wait for interactive requests to drain before it
+	is abandoned. */
+const PREFETCH_MAX_WAIT time.Duration = 10 * time.Second
+
+/** The point widths we prefetch, relative to the one requested, in the order
+	in which plot.js would ask for them. At the requested point width, only
+	the windows to the left and right of the view are prefetched, since the
+	view itself was just served. */
+var prefetchLevels []int = []int{0, -1, 1, -2}
+
+/** A range of statistical records held in the record cache under KEY. */
+type prefetchSpan struct {
+	startTime int64
+	endTime int64
+	key string
+}
+
+type prefetchJob struct {
+	uuid uuid.UUID
+	startTime int64
+	endTime int64
+	pw uint8
+}
+
+/** A Prefetcher anticipates the requests a plot makes after it is drawn, as
+	cacheDataInAdvance in plot.js does: the windows to the left and right of
+	the view, and the next point widths up and down. It queries them in the
+	background, only while the backend is not busy with interactive requests,
+	and keeps the results in the Router's record cache. */
+type Prefetcher struct {
+	rt *Router
+	jobs chan prefetchJob
+	spans map[string][]prefetchSpan // keyed by stream and point width
+	lock *sync.Mutex
+}
+
+/** Enables prefetching with the specified number of background workers.
+	With no workers, nothing is prefetched. */
+func (rt *Router) EnablePrefetch(workers int) {
+	if workers <= 0 {
+		rt.prefetcher = nil
+		return
+	}
+	rt.prefetcher = &Prefetcher{
+		rt: rt,
+		jobs: make(chan prefetchJob, 16 * workers),
+		spans: make(map[string][]prefetchSpan),
+		lock: &sync.Mutex{},
+	}
+	for i := 0; i < workers; i++ {
+		go rt.prefetcher.work()
+	}
+}
+
+func spanIndexKey(uuidBytes uuid.UUID, pw uint8) string {
+	return fmt.Sprintf("%v,%v", uuidBytes.String(), pw)
+}
+
+/** Queues the neighbours of a request that was just served. If the queue is
+	full, the request is dropped; prefetching is only an optimization. A nil
+	Prefetcher ignores every request. */
+func (pf *Prefetcher) Schedule(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) {
+	if pf == nil || pf.rt.derived.Lookup(uuidBytes) != nil {
+		return
+	}
+	select {
+	case pf.jobs <- prefetchJob{uuid: uuidBytes, startTime: startTime, endTime: endTime, pw: pw}:
+	default:
+	}
+}
+
+/** Returns the records for the specified query if they lie within a range
+	that was prefetched. The caller must not modify them. */
+func (pf *Prefetcher) Lookup(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) ([]StatRecord, bool) {
+	if pf == nil {
+		return nil, false
+	}
+	var index string = spanIndexKey(uuidBytes, pw)
+	
+	pf.lock.Lock()
+	var span *prefetchSpan
+	for i := range pf.spans[index] {
+		var candidate *prefetchSpan = &pf.spans[index][i]
+		if candidate.startTime <= startTime && endTime <= candidate.endTime {
+			span = candidate
+			break
+		}
+	}
+	if span == nil {
+		pf.lock.Unlock()
+		return nil, false
+	}
+	var key string = span.key
+	pf.lock.Unlock()
+	
+	records, ok := pf.rt.cache.Get(key)
+	if !ok {
+		pf.forget(index, key) // evicted from the cache
+		return nil, false
+	}
+	var first int = sort.Search(len(records), func (i int) bool {
+		return records[i].Time >= startTime
+	})
+	var last int = sort.Search(len(records), func (i int) bool {
+		return records[i].Time >= endTime
+	})
+	return records[first:last], true
+}
+
+func (pf *Prefetcher) forget(index string, key string) {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	var spans []prefetchSpan = pf.spans[index]
+	for i := range spans {
+		if spans[i].key == key {
+			pf.spans[index] = append(spans[:i], spans[i + 1:]...)
+			break
+		}
+	}
+	if len(pf.spans[index]) == 0 {
+		delete(pf.spans, index)
+	}
+}
+
+func (pf *Prefetcher) work() {
+	for job := range pf.jobs {
+		var span int64 = job.endTime - job.startTime
+		var startTime int64 = job.startTime - span
+		var endTime int64 = job.endTime + span
+		if startTime < QUASAR_LOW || startTime > job.startTime {
+			startTime = QUASAR_LOW
+		}
+		// Data may still arrive for recent windows, which we mustn't cache
+		var settled int64 = settledTime()
+		if endTime > settled || endTime < job.endTime {
+			endTime = settled
+		}
+		
+		for _, level := range prefetchLevels {
+			var pw int = int(job.pw) + level
+			if pw < 0 || pw > 62 {
+				continue
+			}
+			if level == 0 {
+				if !pf.prefetch(job.uuid, startTime, job.startTime, uint8(pw)) || !pf.prefetch(job.uuid, job.endTime, endTime, uint8(pw)) {
+					break
+				}
+				continue
+			}
+			if !pf.prefetch(job.uuid, startTime, endTime, uint8(pw)) {
+				break
+			}
+		}
+	}
+}
+
+/** Prefetches one point width of a job, once the backend is idle enough.
+	Returns false if the rest of the job should be abandoned. */
+func (pf *Prefetcher) prefetch(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) bool {
+	startTime = (startTime >> pw) << pw
+	endTime = (endTime >> pw) << pw
+	if endTime <= startTime || (endTime - startTime) >> pw > PREFETCH_MAX_WINDOWS {
+		return true
+	}
+	if _, ok := pf.Lookup(uuidBytes, startTime, endTime, pw); ok {
+		return true
+	}
+	
+	var pool *BackendPool = pf.rt.resolve([]uuid.UUID{uuidBytes})[0]
+	var deadline time.Time = time.Now().Add(PREFETCH_MAX_WAIT)
+	for pool.backend.Busy() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	
+	records, err := pool.backend.QueryStatisticalValues(uuidBytes, startTime, endTime, pw)
+	if err != nil {
+		fmt.Printf("Could not prefetch stream %v: %v\n", uuidBytes.String(), err)
+		return false
+	}
+	
+	var key string = fmt.Sprintf("prefetch,%v,%v,%v,%v", uuidBytes.String(), startTime, endTime, pw)
+	pf.rt.cache.Put(key, records)
+	
+	var index string = spanIndexKey(uuidBytes, pw)
+	pf.lock.Lock()
+	var spans []prefetchSpan = append(pf.spans[index], prefetchSpan{startTime: startTime, endTime: endTime, key: key})
+	if len(spans) > PREFETCH_MAX_SPANS {
+		spans = spans[len(spans) - PREFETCH_MAX_SPANS:]
+	}
+	pf.spans[index] = spans
+	pf.lock.Unlock()
+	return true
+}
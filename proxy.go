@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/** A ProxyPolicy lists the reverse proxies trusted to report the address of
+	the client they forward a request for in the X-Forwarded-For header. A nil
+	ProxyPolicy trusts no proxies, so that every request is attributed to the
+	address it came from. */
+type ProxyPolicy struct {
+	trusted []*net.IPNet
+}
+
+/** Parses a comma-separated list of IP addresses and CIDR ranges, such as
+	"127.0.0.1,10.0.0.0/8". */
+func NewProxyPolicy(proxies string) (*ProxyPolicy, error) {
+	var pp *ProxyPolicy = &ProxyPolicy{trusted: make([]*net.IPNet, 0)}
+	for _, proxy := range strings.Split(proxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			var ip net.IP = net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy address %v", proxy)
+			}
+			var bits int = 8 * len(ip)
+			pp.trusted = append(pp.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy range %v", proxy)
+		}
+		pp.trusted = append(pp.trusted, network)
+	}
+	return pp, nil
+}
+
+func (pp *ProxyPolicy) trusts(host string) bool {
+	if pp == nil {
+		return false
+	}
+	var ip net.IP = net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range pp.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/** Returns the IP address of the client that made a request. If the request
+	came through trusted proxies, this is the last address in X-Forwarded-For
+	that was not added by one of them; a client can put anything it likes at
+	the start of the header, so only the addresses appended by trusted proxies
+	are believed. */
+func (pp *ProxyPolicy) ClientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !pp.trusts(host) {
+		return host
+	}
+	
+	var forwarded []string = strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		var hop string = strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !pp.trusts(hop) {
+			break
+		}
+	}
+	return host
+}
@@ -0,0 +1,142 @@
+/** Package quasar is a client for QUASAR, the time series database, over its
+	Cap'n Proto interface. A DataRequester keeps a set of connections to the
+	replicas of a QUASAR cluster and answers statistical, windowed and bracket
+	queries with typed results. The package never prints; problems with
+	individual connections are passed to the handler set with OnError. */
+package quasar
+
+import (
+	"sync"
+	
+	cpint "github.com/SoftwareDefinedBuildings/quasar/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+const (
+	/* The earliest and latest times QUASAR can store. */
+	MIN_TIME int64 = 1 - (16 << 56)
+	MAX_TIME int64 = (48 << 56) - 1
+	
+	/* Marks a stream boundary that could not be determined. */
+	INVALID_TIME int64 = -0x8000000000000000
+)
+
+/** A statistical summary of the points in one window of a stream. */
+type StatRecord struct {
+	Time int64
+	Min float64
+	Mean float64
+	Max float64
+	Count uint64
+}
+
+/** A single point of a stream. */
+type Point struct {
+	Time int64
+	Value float64
+}
+
+/** The times of the earliest and latest points of a stream. Both are
+	INVALID_TIME if the stream has no points, or if they could not be
+	determined. */
+type Bracket struct {
+	Left int64
+	Right int64
+}
+
+/** Splits a time in nanoseconds into milliseconds and the remaining
+	nanoseconds, which is how the plotter represents times. */
+func SplitTime(time int64) (millis int64, nanos int32) {
+	millis = time / 1000000
+	nanos = int32(time % 1000000)
+	if nanos < 0 {
+		nanos += 1000000
+		millis++
+	}
+	return
+}
+
+/** The version number with which QUASAR serves the latest version of a
+	stream. We never query older versions. */
+const LATEST_VERSION uint64 = 0
+
+type queryMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	query *cpint.CmdQueryStatisticalValues
+}
+
+var queryPool sync.Pool = sync.Pool{
+	New: func () interface{} {
+		var seg *capnp.Segment = capnp.NewBuffer(nil)
+		var req cpint.Request = cpint.NewRootRequest(seg)
+		var query cpint.CmdQueryStatisticalValues = cpint.NewCmdQueryStatisticalValues(seg)
+		query.SetVersion(LATEST_VERSION)
+		return queryMessagePart{
+			segment: seg,
+			request: &req,
+			query: &query,
+		}
+	},
+}
+
+type windowMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	wquery *cpint.CmdQueryWindowValues
+}
+
+var windowPool sync.Pool = sync.Pool{
+	New: func () interface{} {
+		var seg *capnp.Segment = capnp.NewBuffer(nil)
+		var req cpint.Request = cpint.NewRootRequest(seg)
+		var wquery cpint.CmdQueryWindowValues = cpint.NewCmdQueryWindowValues(seg)
+		wquery.SetVersion(LATEST_VERSION)
+		wquery.SetDepth(0)
+		return windowMessagePart{
+			segment: seg,
+			request: &req,
+			wquery: &wquery,
+		}
+	},
+}
+
+type standardMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	squery *cpint.CmdQueryStandardValues
+}
+
+var standardPool sync.Pool = sync.Pool{
+	New: func () interface{} {
+		var seg *capnp.Segment = capnp.NewBuffer(nil)
+		var req cpint.Request = cpint.NewRootRequest(seg)
+		var squery cpint.CmdQueryStandardValues = cpint.NewCmdQueryStandardValues(seg)
+		squery.SetVersion(LATEST_VERSION)
+		return standardMessagePart{
+			segment: seg,
+			request: &req,
+			squery: &squery,
+		}
+	},
+}
+
+type bracketMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	bquery *cpint.CmdQueryNearestValue
+}
+
+var bracketPool sync.Pool = sync.Pool{
+	New: func () interface{} {
+		var seg *capnp.Segment = capnp.NewBuffer(nil)
+		var req cpint.Request = cpint.NewRootRequest(seg)
+		var bquery cpint.CmdQueryNearestValue = cpint.NewCmdQueryNearestValue(seg)
+		bquery.SetVersion(LATEST_VERSION)
+		return bracketMessagePart{
+			segment: seg,
+			request: &req,
+			bquery: &bquery,
+		}
+	},
+}
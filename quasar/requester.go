@@ -0,0 +1,816 @@
+package quasar
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	
+	cpint "github.com/SoftwareDefinedBuildings/quasar/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** The outcome of a single query sent to QUASAR. */
+const (
+	RESPONSE_OK int = iota
+	RESPONSE_ERROR
+	RESPONSE_CONN_LOST
+)
+
+/** The longest we wait between attempts to reconnect to a replica. */
+const MAX_RECONNECT_BACKOFF time.Duration = 30 * time.Second
+
+type queryOutcome struct {
+	id uint64
+	status int
+	code cpint.StatusCode
+	records []StatRecord
+	points []Point
+}
+
+/** A replica is one of several equivalent QUASAR servers. Each connection
+	to a replica fails and reconnects on its own, so a replica is only out of
+	use once all of its connections are down. */
+type replica struct {
+	addr string
+}
+
+/** A single connection to a replica. OUTSTANDING holds the echo tags of the
+	queries that were sent on this connection and have not been answered. */
+type quasarConn struct {
+	replica *replica
+	conn net.Conn
+	sendLock *sync.Mutex
+	up bool
+	outstanding map[uint64]bool
+}
+
+/** DataRequester encapsulates a series of connections used for obtaining data
+	from QUASAR. The connections are spread across a set of equivalent
+	replicas; queries interrupted by a failed connection are retried on
+	another connection, preferably to another replica. */
+type DataRequester struct {
+	connections []*quasarConn
+	replicas []*replica
+	currID uint64
+	connID uint32
+	pending uint32
+	maxPending uint32
+	pendingLock *sync.Mutex
+	stateLock *sync.Mutex // protects the maps below and the state of the connections and replicas
+	synchronizers map[uint64]chan queryOutcome
+	boundaries map[uint64]int64
+	raw map[uint64]bool // the queries for raw values, whose responses hold points
+	partial map[uint64]*queryOutcome // responses of which more messages are to come
+	flights map[flightKey]*flight
+	flightLock *sync.Mutex
+	responseHandler func(*quasarConn, net.Conn)
+	onError func(error)
+	missed []error // errors reported before OnError was called
+	alive bool
+}
+
+/** Identifies a query for statistical records, so that identical queries
+	that are in flight at the same time can share one round trip. Statistical
+	queries have a WIDTH of zero; windowed queries have a PW of zero. */
+type flightKey struct {
+	uuid string
+	startTime int64
+	endTime int64
+	pw uint8
+	width uint64
+	version uint64
+}
+
+/** A query in flight. DONE is closed once RECORDS and ERR are set. */
+type flight struct {
+	done chan bool
+	records []StatRecord
+	err error
+}
+
+/** Creates a new DataRequester object.
+	dbAddrs - the addresses of equivalent replicas of the database from where
+		to obtain data.
+	numConnections - the number of connections to use, spread evenly across
+		the replicas.
+	maxPending - a limit on the maximum number of pending requests.
+	bracket - whether or not the new DataRequester will be used for bracket calls.
+	Returns an error if no address is given or no connection can be made.
+	Connections that can't be made at first are retried in the background,
+	and the reasons they failed are passed to the OnError handler. */
+func NewDataRequester(dbAddrs []string, numConnections int, maxPending uint32, bracket bool) (*DataRequester, error) {
+	var replicas []*replica = make([]*replica, len(dbAddrs))
+	var connections []*quasarConn = make([]*quasarConn, numConnections)
+	var err error
+	var i int
+	for i = 0; i < len(dbAddrs); i++ {
+		replicas[i] = &replica{
+			addr: dbAddrs[i],
+		}
+	}
+	
+	var dr *DataRequester = &DataRequester{
+		connections: connections,
+		replicas: replicas,
+		currID: 0,
+		connID: 0,
+		pending: 0,
+		maxPending: maxPending,
+		pendingLock: &sync.Mutex{},
+		stateLock: &sync.Mutex{},
+		synchronizers: make(map[uint64]chan queryOutcome),
+		boundaries: make(map[uint64]int64),
+		raw: make(map[uint64]bool),
+		partial: make(map[uint64]*queryOutcome),
+		flights: make(map[flightKey]*flight),
+		flightLock: &sync.Mutex{},
+		alive: true,
+	}
+	
+	if bracket {
+		dr.responseHandler = dr.handleBracketResponse
+	} else {
+		dr.responseHandler = dr.handleDataResponse
+	}
+	
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("No database address was specified")
+	}
+	
+	var numUp int = 0
+	for i = 0; i < numConnections; i++ {
+		var qc *quasarConn = &quasarConn{
+			replica: replicas[i % len(replicas)],
+			sendLock: &sync.Mutex{},
+			up: false,
+			outstanding: make(map[uint64]bool),
+		}
+		connections[i] = qc
+		qc.conn, err = net.Dial("tcp", qc.replica.addr)
+		if err != nil {
+			dr.missed = append(dr.missed, fmt.Errorf("Could not connect to database at %v: %v", qc.replica.addr, err))
+			go dr.reconnect(qc)
+			continue
+		}
+		qc.up = true
+		numUp++
+		go dr.responseHandler(qc, qc.conn)
+	}
+	
+	if numUp == 0 {
+		dr.Stop()
+		return nil, fmt.Errorf("Could not connect to database at %v: %v", dbAddrs, err)
+	}
+	
+	return dr, nil
+}
+
+/** Chooses a connection that is up and not in EXCLUDE, in round-robin
+	order. Connections to replicas other than those of the connections in
+	EXCLUDE are preferred, since a failure often affects a whole replica.
+	Returns nil if there is no such connection. */
+func (dr *DataRequester) pickConnection(exclude map[*quasarConn]bool) *quasarConn {
+	var numConns uint32 = uint32(len(dr.connections))
+	var start uint32 = atomic.AddUint32(&dr.connID, 1)
+	var i uint32
+	
+	var avoid map[*replica]bool = make(map[*replica]bool)
+	for qc := range exclude {
+		avoid[qc.replica] = true
+	}
+	
+	dr.stateLock.Lock()
+	defer dr.stateLock.Unlock()
+	
+	var fallback *quasarConn
+	for i = 0; i < numConns; i++ {
+		qc := dr.connections[(start + i) % numConns]
+		if !qc.up || exclude[qc] {
+			continue
+		}
+		if !avoid[qc.replica] {
+			return qc
+		}
+		if fallback == nil {
+			fallback = qc
+		}
+	}
+	return fallback
+}
+
+/** Sends the query in SEGMENT, tagged with ID, over a usable connection not
+	in EXCLUDE. If sending fails, the connection is marked as failed and
+	another one is tried. Returns the connection on which the query was sent. */
+func (dr *DataRequester) sendQuery(segment *capnp.Segment, id uint64, synchronizer chan queryOutcome, exclude map[*quasarConn]bool) (*quasarConn, error) {
+	for true {
+		qc := dr.pickConnection(exclude)
+		if qc == nil {
+			return nil, fmt.Errorf("no connection to a replica is available")
+		}
+		
+		qc.sendLock.Lock()
+		dr.stateLock.Lock()
+		if !qc.up {
+			// The connection failed after we picked it
+			dr.stateLock.Unlock()
+			qc.sendLock.Unlock()
+			continue
+		}
+		var conn net.Conn = qc.conn
+		dr.synchronizers[id] = synchronizer
+		qc.outstanding[id] = true
+		dr.stateLock.Unlock()
+		_, sendErr := segment.WriteTo(conn)
+		qc.sendLock.Unlock()
+		
+		if sendErr == nil {
+			return qc, nil
+		}
+		
+		dr.stateLock.Lock()
+		delete(qc.outstanding, id)
+		dr.stateLock.Unlock()
+		dr.connectionFailed(qc, conn, sendErr)
+		exclude[qc] = true
+	}
+	return nil, nil
+}
+
+/** Marks a connection as failed because of CAUSE, and notifies the queries that were waiting on it so that they can
+	be retried. */
+func (dr *DataRequester) connectionFailed(qc *quasarConn, conn net.Conn, cause error) {
+	dr.stateLock.Lock()
+	if !qc.up || qc.conn != conn {
+		// Someone else already handled this failure
+		dr.stateLock.Unlock()
+		return
+	}
+	qc.up = false
+	conn.Close()
+	dr.reportLocked(fmt.Errorf("Lost connection to database at %v: %v", qc.replica.addr, cause))
+	for id := range qc.outstanding {
+		// The retry starts the response over
+		delete(dr.partial, id)
+		synchronizer, ok := dr.synchronizers[id]
+		if ok {
+			// Synchronizers have room for every outstanding query, so this won't block
+			synchronizer <- queryOutcome{id: id, status: RESPONSE_CONN_LOST}
+		}
+	}
+	qc.outstanding = make(map[uint64]bool)
+	dr.stateLock.Unlock()
+	
+	if dr.alive {
+		go dr.reconnect(qc)
+	}
+}
+
+/** Tries to reestablish a failed connection, backing off exponentially. */
+func (dr *DataRequester) reconnect(qc *quasarConn) {
+	var backoff time.Duration = time.Second
+	for dr.alive {
+		time.Sleep(backoff)
+		conn, err := net.Dial("tcp", qc.replica.addr)
+		if err != nil {
+			if backoff < MAX_RECONNECT_BACKOFF {
+				backoff *= 2
+			}
+			continue
+		}
+		
+		dr.stateLock.Lock()
+		qc.conn = conn
+		qc.up = true
+		dr.reportLocked(fmt.Errorf("Reconnected to database at %v", qc.replica.addr))
+		dr.stateLock.Unlock()
+		
+		go dr.responseHandler(qc, conn)
+		return
+	}
+}
+
+/** Sets a function to be called with an error whenever a connection to a
+	replica is lost or restored, or a query has to be retried or is refused.
+	The errors reported before the handler was set, such as connections that
+	could not be made at first, are passed to it right away. The function is
+	called with internal locks held, so it must not call back into the
+	DataRequester. */
+func (dr *DataRequester) OnError(handler func (error)) {
+	dr.stateLock.Lock()
+	dr.onError = handler
+	for _, err := range dr.missed {
+		handler(err)
+	}
+	dr.missed = nil
+	dr.stateLock.Unlock()
+}
+
+/** Passes ERR to the OnError handler, if there is one. */
+func (dr *DataRequester) report(err error) {
+	dr.stateLock.Lock()
+	dr.reportLocked(err)
+	dr.stateLock.Unlock()
+}
+
+/** Like report, but the caller must hold the state lock. */
+func (dr *DataRequester) reportLocked(err error) {
+	if dr.onError != nil {
+		dr.onError(err)
+	}
+}
+
+/** Removes the bookkeeping for the query tagged with ID. */
+func (dr *DataRequester) forget(id uint64) {
+	dr.stateLock.Lock()
+	delete(dr.synchronizers, id)
+	delete(dr.boundaries, id)
+	delete(dr.raw, id)
+	delete(dr.partial, id)
+	dr.stateLock.Unlock()
+}
+
+/** Looks up the synchronizer for the response to the query tagged with ID,
+	and marks that query as answered on QC. */
+func (dr *DataRequester) claimResponse(qc *quasarConn, id uint64) chan queryOutcome {
+	dr.stateLock.Lock()
+	defer dr.stateLock.Unlock()
+	delete(qc.outstanding, id)
+	delete(dr.partial, id)
+	return dr.synchronizers[id]
+}
+
+/** Adds PART, one message of the response to the query tagged with ID, to
+	the messages received before it. Once the FINAL message arrives, marks
+	the query as answered on QC and returns its synchronizer and the whole
+	response; until then, returns a nil synchronizer. */
+func (dr *DataRequester) collect(qc *quasarConn, id uint64, final bool, part queryOutcome) (chan queryOutcome, queryOutcome) {
+	dr.stateLock.Lock()
+	defer dr.stateLock.Unlock()
+	outcome, ok := dr.partial[id]
+	if ok {
+		outcome.records = append(outcome.records, part.records...)
+		outcome.points = append(outcome.points, part.points...)
+	} else {
+		outcome = &part
+	}
+	
+	if !final {
+		if dr.synchronizers[id] != nil {
+			dr.partial[id] = outcome
+		}
+		return nil, queryOutcome{}
+	}
+	delete(qc.outstanding, id)
+	delete(dr.partial, id)
+	return dr.synchronizers[id], *outcome
+}
+/** Waits until fewer than maxPending requests are pending, and then counts
+	a new pending request. The caller must call releasePending when done. */
+func (dr *DataRequester) acquirePending() {
+	for true {
+		dr.pendingLock.Lock()
+		if dr.pending < dr.maxPending {
+			dr.pending += 1
+			dr.pendingLock.Unlock()
+			break
+		} else {
+			dr.pendingLock.Unlock()
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (dr *DataRequester) releasePending() {
+	atomic.AddUint32(&dr.pending, 0xFFFFFFFF)
+}
+
+/** Runs QUERY, unless an identical query is already in flight, in which case
+	waits for that query and shares its result. Callers must not modify the
+	records returned, since other callers may hold the same slice. */
+func (dr *DataRequester) coalesce(key flightKey, query func () ([]StatRecord, error)) ([]StatRecord, error) {
+	dr.flightLock.Lock()
+	f, ok := dr.flights[key]
+	if ok {
+		dr.flightLock.Unlock()
+		<-f.done
+		return f.records, f.err
+	}
+	f = &flight{done: make(chan bool)}
+	dr.flights[key] = f
+	dr.flightLock.Unlock()
+	
+	f.records, f.err = query()
+	
+	dr.flightLock.Lock()
+	delete(dr.flights, key)
+	dr.flightLock.Unlock()
+	close(f.done)
+	return f.records, f.err
+}
+
+/** Obtains statistical records for the specified stream, in windows of width
+	2^PW nanoseconds between STARTTIME (inclusive) and ENDTIME (exclusive).
+	Concurrent identical queries share one round trip to the database. */
+func (dr *DataRequester) QueryStatisticalValues(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) ([]StatRecord, error) {
+	var key flightKey = flightKey{
+		uuid: uuidBytes.String(),
+		startTime: startTime,
+		endTime: endTime,
+		pw: pw,
+		version: LATEST_VERSION,
+	}
+	return dr.coalesce(key, func () ([]StatRecord, error) {
+		return dr.queryStatisticalValues(uuidBytes, startTime, endTime, pw)
+	})
+}
+
+func (dr *DataRequester) queryStatisticalValues(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) ([]StatRecord, error) {
+	dr.acquirePending()
+	defer dr.releasePending()
+	
+	var mp queryMessagePart = queryPool.Get().(queryMessagePart)
+	
+	// We may need to resend the message, so we hold on to it until we're done
+	defer queryPool.Put(mp)
+	
+	segment := mp.segment
+	request := mp.request
+	query := mp.query
+	
+	query.SetUuid([]byte(uuidBytes))
+	query.SetStartTime(startTime)
+	query.SetEndTime(endTime)
+	query.SetPointWidth(pw)
+	
+	id := atomic.AddUint64(&dr.currID, 1)
+	
+	request.SetEchoTag(id)
+	
+	request.SetQueryStatisticalValues(*query)
+	
+	return dr.awaitRecords(segment, id)
+}
+
+/** Obtains statistical records for the specified stream, in consecutive
+	windows of exactly WIDTH nanoseconds, the first of which begins at
+	STARTTIME. Windows that would extend past ENDTIME are left out.
+	Concurrent identical queries share one round trip to the database. */
+func (dr *DataRequester) QueryWindowValues(uuidBytes uuid.UUID, startTime int64, endTime int64, width uint64) ([]StatRecord, error) {
+	var key flightKey = flightKey{
+		uuid: uuidBytes.String(),
+		startTime: startTime,
+		endTime: endTime,
+		width: width,
+		version: LATEST_VERSION,
+	}
+	return dr.coalesce(key, func () ([]StatRecord, error) {
+		return dr.queryWindowValues(uuidBytes, startTime, endTime, width)
+	})
+}
+
+func (dr *DataRequester) queryWindowValues(uuidBytes uuid.UUID, startTime int64, endTime int64, width uint64) ([]StatRecord, error) {
+	dr.acquirePending()
+	defer dr.releasePending()
+	
+	var mp windowMessagePart = windowPool.Get().(windowMessagePart)
+	
+	defer windowPool.Put(mp)
+	
+	segment := mp.segment
+	request := mp.request
+	wquery := mp.wquery
+	
+	wquery.SetUuid([]byte(uuidBytes))
+	wquery.SetStartTime(startTime)
+	wquery.SetEndTime(endTime)
+	wquery.SetWidth(width)
+	
+	id := atomic.AddUint64(&dr.currID, 1)
+	
+	request.SetEchoTag(id)
+	
+	request.SetQueryWindowValues(*wquery)
+	
+	return dr.awaitRecords(segment, id)
+}
+
+/** Obtains the points of the specified stream between STARTTIME (inclusive)
+	and ENDTIME (exclusive). */
+func (dr *DataRequester) QueryRawValues(uuidBytes uuid.UUID, startTime int64, endTime int64) ([]Point, error) {
+	dr.acquirePending()
+	defer dr.releasePending()
+	
+	var mp standardMessagePart = standardPool.Get().(standardMessagePart)
+	
+	defer standardPool.Put(mp)
+	
+	segment := mp.segment
+	request := mp.request
+	squery := mp.squery
+	
+	squery.SetUuid([]byte(uuidBytes))
+	squery.SetStartTime(startTime)
+	squery.SetEndTime(endTime)
+	
+	id := atomic.AddUint64(&dr.currID, 1)
+	
+	request.SetEchoTag(id)
+	
+	request.SetQueryStandardValues(*squery)
+	
+	dr.stateLock.Lock()
+	dr.raw[id] = true
+	dr.stateLock.Unlock()
+	
+	outcome, err := dr.await(segment, id)
+	return outcome.points, err
+}
+
+/** Sends the query in SEGMENT, tagged with ID, and waits for the statistical
+	records in the response. */
+func (dr *DataRequester) awaitRecords(segment *capnp.Segment, id uint64) ([]StatRecord, error) {
+	outcome, err := dr.await(segment, id)
+	return outcome.records, err
+}
+
+/** Sends the query in SEGMENT, tagged with ID, and waits for the response.
+	If the connection fails before the response arrives, the query is resent
+	on another connection, preferably to another replica. */
+func (dr *DataRequester) await(segment *capnp.Segment, id uint64) (queryOutcome, error) {
+	var synchronizer chan queryOutcome = make(chan queryOutcome, 1)
+	var tried map[*quasarConn]bool = make(map[*quasarConn]bool)
+	
+	defer dr.forget(id)
+	
+	for true {
+		qc, sendErr := dr.sendQuery(segment, id, synchronizer, tried)
+		if sendErr != nil {
+			return queryOutcome{}, fmt.Errorf("Could not send query to database: %v", sendErr)
+		}
+		
+		outcome := <- synchronizer
+		if outcome.status == RESPONSE_OK {
+			return outcome, nil
+		} else if outcome.status == RESPONSE_ERROR {
+			return queryOutcome{}, fmt.Errorf("Database returns status code %v", outcome.code)
+		}
+		
+		dr.report(fmt.Errorf("Lost connection to database at %v during query; retrying on another connection", qc.replica.addr))
+		tried[qc] = true
+	}
+	return queryOutcome{}, nil
+}
+
+/** A function designed to handle QUASAR's response over Cap'n Proto.
+	You shouldn't ever have to invoke this function. It is used internally by
+	the constructor function. */
+func (dr *DataRequester) handleDataResponse(qc *quasarConn, connection net.Conn) {
+	for dr.alive {
+		// Only one goroutine will be reading at a time, so a lock isn't needed
+		responseSegment, respErr := capnp.ReadFromStream(connection, nil)
+		
+		if respErr != nil {
+			if !dr.alive {
+				break
+			}
+			dr.connectionFailed(qc, connection, respErr)
+			return
+		}
+		
+		responseSeg := cpint.ReadRootResponse(responseSegment)
+		id := responseSeg.EchoTag()
+		status := responseSeg.StatusCode()
+		
+		if status != cpint.STATUSCODE_OK {
+			synchronizer := dr.claimResponse(qc, id)
+			if synchronizer != nil {
+				synchronizer <- queryOutcome{id: id, status: RESPONSE_ERROR, code: status}
+			}
+			continue
+		}
+		
+		// A long response arrives in several messages, the last of which is final
+		var part queryOutcome = queryOutcome{id: id, status: RESPONSE_OK}
+		dr.stateLock.Lock()
+		var raw bool = dr.raw[id]
+		dr.stateLock.Unlock()
+		if raw {
+			points := responseSeg.Records().Values()
+			part.points = make([]Point, points.Len())
+			for i := range part.points {
+				point := points.At(i)
+				part.points[i] = Point{Time: point.Time(), Value: point.Value()}
+			}
+		} else {
+			records := responseSeg.StatisticalRecords().Values()
+			length := records.Len()
+			part.records = make([]StatRecord, length)
+			for i := 0; i < length; i++ {
+				record := records.At(i)
+				part.records[i] = StatRecord{
+					Time: record.Time(),
+					Min: record.Min(),
+					Mean: record.Mean(),
+					Max: record.Max(),
+					Count: record.Count(),
+				}
+			}
+		}
+		
+		synchronizer, outcome := dr.collect(qc, id, responseSeg.Final(), part)
+		if synchronizer != nil {
+			synchronizer <- outcome
+		}
+	}
+}
+/** Obtains the earliest and latest point of each of the specified UUIDs.
+	A stream whose boundary could not be determined has INVALID_TIME as its
+	boundary. The DataRequester must have been created for bracket calls. */
+func (dr *DataRequester) QueryBrackets(uuids []uuid.UUID) (brackets []Bracket, err error) {
+	dr.acquirePending()
+	defer dr.releasePending()
+	
+	var mp bracketMessagePart = bracketPool.Get().(bracketMessagePart)
+	
+	defer bracketPool.Put(mp)
+	
+	var numResponses int = 2 * len(uuids)
+	var responseChan chan queryOutcome = make(chan queryOutcome, numResponses)
+	
+	var idsUsed []uint64 = make([]uint64, numResponses) // Due to concurrency, we could use a non-contiguous block of IDs
+	var indices map[uint64]int = make(map[uint64]int)
+	var sentTo []*quasarConn = make([]*quasarConn, numResponses)
+	var tried []map[*quasarConn]bool = make([]map[*quasarConn]bool, numResponses)
+	
+	defer func () {
+		for _, usedID := range idsUsed {
+			if usedID != 0 {
+				dr.forget(usedID)
+			}
+		}
+	}()
+	
+	// Query i asks for the left boundary of stream i / 2 if i is even, and for its right boundary if i is odd
+	var sendBracketQuery = func (i int) error {
+		var id uint64 = idsUsed[i]
+		mp.bquery.SetUuid([]byte(uuids[i >> 1]))
+		if (i & 1) == 0 {
+			mp.bquery.SetTime(MIN_TIME)
+			mp.bquery.SetBackward(false)
+		} else {
+			mp.bquery.SetTime(MAX_TIME)
+			mp.bquery.SetBackward(true)
+		}
+		mp.request.SetEchoTag(id)
+		mp.request.SetQueryNearestValue(*mp.bquery)
+		
+		qc, sendErr := dr.sendQuery(mp.segment, id, responseChan, tried[i])
+		if sendErr != nil {
+			return fmt.Errorf("Could not send query to database: %v", sendErr)
+		}
+		sentTo[i] = qc
+		return nil
+	}
+	
+	var i int
+	for i = 0; i < numResponses; i++ {
+		idsUsed[i] = atomic.AddUint64(&dr.currID, 1)
+		indices[idsUsed[i]] = i
+		tried[i] = make(map[*quasarConn]bool)
+		
+		dr.stateLock.Lock()
+		dr.boundaries[idsUsed[i]] = INVALID_TIME
+		dr.stateLock.Unlock()
+		
+		err = sendBracketQuery(i)
+		if err != nil {
+			return
+		}
+	}
+	
+	for received := 0; received < numResponses; {
+		outcome := <- responseChan
+		if outcome.status != RESPONSE_CONN_LOST {
+			received++
+			continue
+		}
+		
+		i = indices[outcome.id]
+		dr.report(fmt.Errorf("Lost connection to database at %v during bracket query; retrying on another connection", sentTo[i].replica.addr))
+		tried[i][sentTo[i]] = true
+		err = sendBracketQuery(i)
+		if err != nil {
+			return
+		}
+	}
+	
+	brackets = make([]Bracket, len(uuids))
+	dr.stateLock.Lock()
+	for i = 0; i < len(uuids); i++ {
+		brackets[i] = Bracket{
+			Left: dr.boundaries[idsUsed[i << 1]],
+			Right: dr.boundaries[idsUsed[(i << 1) + 1]],
+		}
+	}
+	dr.stateLock.Unlock()
+	
+	return
+}
+/** A function designed to handle QUASAR's response over Cap'n Proto.
+	You shouldn't ever have to invoke this function. It is used internally by
+	the constructor function. */
+func (dr *DataRequester) handleBracketResponse(qc *quasarConn, connection net.Conn) {
+	for dr.alive {
+		// Only one goroutine will be reading at a time, so a lock isn't needed
+		responseSegment, respErr := capnp.ReadFromStream(connection, nil)
+		
+		if respErr != nil {
+			if !dr.alive {
+				break
+			}
+			dr.connectionFailed(qc, connection, respErr)
+			return
+		}
+		
+		responseSeg := cpint.ReadRootResponse(responseSegment)
+		id := responseSeg.EchoTag()
+		status := responseSeg.StatusCode()
+		records := responseSeg.Records().Values()
+		
+		synchronizer := dr.claimResponse(qc, id)
+		if synchronizer == nil {
+			// The request was abandoned
+			continue
+		}
+		
+		if status != cpint.STATUSCODE_OK {
+			dr.report(fmt.Errorf("Error in bracket call to %v: database returns status code %v", qc.replica.addr, status))
+			synchronizer <- queryOutcome{id: id, status: RESPONSE_ERROR, code: status}
+			continue
+		}
+		
+		if records.Len() > 0 {
+			dr.stateLock.Lock()
+			dr.boundaries[id] = records.At(0).Time()
+			dr.stateLock.Unlock()
+		}
+		
+		synchronizer <- queryOutcome{id: id, status: RESPONSE_OK}
+	}
+}
+
+/** Closes the connections of the DataRequester. It must not be used
+	afterward. */
+func (dr *DataRequester) Stop() {
+	dr.alive = false
+	dr.stateLock.Lock()
+	for _, qc := range dr.connections {
+		if qc != nil && qc.up {
+			qc.up = false
+			qc.conn.Close()
+		}
+	}
+	dr.stateLock.Unlock()
+}
+
+/** Returns true if at least half of the allowed requests are pending, in
+	which case background work should wait. */
+func (dr *DataRequester) Busy() bool {
+	return atomic.LoadUint32(&dr.pending) * 2 >= dr.maxPending
+}
+
+/** The state of one connection to a replica. */
+type ConnectionStatus struct {
+	Replica string `json:"replica"`
+	Up bool `json:"up"`
+	InFlight int `json:"in_flight"`
+}
+
+/** The state of a DataRequester, for monitoring. */
+type Status struct {
+	Pending uint32 `json:"pending"`
+	MaxPending uint32 `json:"max_pending"`
+	Connections []ConnectionStatus `json:"connections"`
+}
+
+/** Describes the connections of the DataRequester and its pending queries. */
+func (dr *DataRequester) Status() Status {
+	var rs Status = Status{
+		Pending: atomic.LoadUint32(&dr.pending),
+		MaxPending: dr.maxPending,
+		Connections: make([]ConnectionStatus, len(dr.connections)),
+	}
+	dr.stateLock.Lock()
+	for i, qc := range dr.connections {
+		rs.Connections[i] = ConnectionStatus{
+			Replica: qc.replica.addr,
+			Up: qc.up,
+			InFlight: len(qc.outstanding),
+		}
+	}
+	dr.stateLock.Unlock()
+	return rs
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** The time zone of calendar rollups that do not name one. It is set from
+	the rollup_timezone key of plotter.ini. */
+var defaultRollupZone *time.Location = time.UTC
+
+/** The shortest length of each calendar period, used to estimate how many
+	periods a range holds. */
+var rollupPeriods map[string]time.Duration = map[string]time.Duration{
+	"hour": time.Hour,
+	"day": 23 * time.Hour, // the shortest day, when DST begins
+	"month": 28 * 24 * time.Hour,
+}
+
+var zoneCache map[string]*time.Location = make(map[string]*time.Location)
+var zoneCacheLock *sync.Mutex = &sync.Mutex{}
+
+/** A Rollup summarizes a stream by calendar period in a time zone, so that,
+	for example, each day begins at local midnight even across DST changes. */
+type Rollup struct {
+	Period string
+	Location *time.Location
+}
+
+/** Returns true if the resolution field of a data request names a calendar
+	period rather than a point width. */
+func IsRollupSpec(spec string) bool {
+	var period string = strings.SplitN(spec, "@", 2)[0]
+	_, ok := rollupPeriods[period]
+	return ok
+}
+
+/** Parses a rollup of the form "PERIOD" or "PERIOD@ZONE", where PERIOD is
+	hour, day or month and ZONE is a name from the IANA time zone database. */
+func ParseRollup(spec string) (*Rollup, error) {
+	var parts []string = strings.SplitN(spec, "@", 2)
+	if _, ok := rollupPeriods[parts[0]]; !ok {
+		return nil, fmt.Errorf("Unknown calendar period %v", parts[0])
+	}
+	var rollup *Rollup = &Rollup{Period: parts[0], Location: defaultRollupZone}
+	if len(parts) == 2 {
+		zoneCacheLock.Lock()
+		defer zoneCacheLock.Unlock()
+		loc, ok := zoneCache[parts[1]]
+		if !ok {
+			var err error
+			loc, err = time.LoadLocation(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("Unknown time zone %v", parts[1])
+			}
+			zoneCache[parts[1]] = loc
+		}
+		rollup.Location = loc
+	}
+	return rollup, nil
+}
+
+func (r *Rollup) String() string {
+	return r.Period + "@" + r.Location.String()
+}
+
+/** Returns the start of the period containing T, in nanoseconds. */
+func (r *Rollup) Floor(t int64) int64 {
+	var local time.Time = time.Unix(0, t).In(r.Location)
+	switch r.Period {
+	case "hour":
+		// Subtracting the offset into the hour, rather than rebuilding the time
+		// from its fields, keeps the repeated hour at the end of DST distinct
+		var into time.Duration = time.Duration(local.Minute()) * time.Minute + time.Duration(local.Second()) * time.Second + time.Duration(local.Nanosecond())
+		return local.Add(-into).UnixNano()
+	case "day":
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, r.Location).UnixNano()
+	default:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, r.Location).UnixNano()
+	}
+}
+
+/** Returns the start of the period following the one that starts at T. */
+func (r *Rollup) Next(t int64) int64 {
+	var local time.Time = time.Unix(0, t).In(r.Location)
+	switch r.Period {
+	case "hour":
+		return local.Add(time.Hour).UnixNano()
+	case "day":
+		return time.Date(local.Year(), local.Month(), local.Day() + 1, 0, 0, 0, 0, r.Location).UnixNano()
+	default:
+		return time.Date(local.Year(), local.Month() + 1, 1, 0, 0, 0, 0, r.Location).UnixNano()
+	}
+}
+
+/** Returns the length of the shortest period, in nanoseconds. */
+func (r *Rollup) shortestPeriod() int64 {
+	return int64(rollupPeriods[r.Period])
+}
+
+/** Obtains statistical records for a stream summarized by calendar period.
+	STARTTIME and ENDTIME must be period boundaries. Each record in the result
+	is timestamped with the start of its period and summarizes exactly that
+	period. Consecutive periods of the same length, such as the days between
+	two DST changes, are fetched with one windowed query. */
+func (rt *Router) QueryRollup(uuidBytes uuid.UUID, startTime int64, endTime int64, rollup *Rollup) ([]StatRecord, error) {
+	var result []StatRecord = make([]StatRecord, 0)
+	var runStart int64 = startTime
+	for runStart < endTime {
+		var length int64 = rollup.Next(runStart) - runStart
+		var runEnd int64 = runStart + length
+		for runEnd < endTime && rollup.Next(runEnd) - runEnd == length {
+			runEnd += length
+		}
+		
+		records, err := rt.QueryWidth(uuidBytes, runStart, runEnd, length)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, records...)
+		runStart = runEnd
+	}
+	return result, nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** A BackendPool is a named backend to which streams are routed. */
+type BackendPool struct {
+	name string
+	backend Backend
+}
+
+/** The format of the routing file. DEFAULT names the pool used for streams
+	that match no other rule, PATHS maps metadata Path prefixes to pool names,
+	and UUIDS maps individual streams to pool names. */
+type RoutingConfig struct {
+	Default string `json:"default"`
+	Paths map[string]string `json:"paths"`
+	Uuids map[string]string `json:"uuids"`
+}
+
+type pathRoute struct {
+	prefix string
+	pool *BackendPool
+}
+
+/** A Router decides which backend pool serves each stream, and fans requests
+	out across pools when they involve streams in more than one of them. */
+type Router struct {
+	pools map[string]*BackendPool
+	defaultPool *BackendPool
+	uuidRoutes map[string]*BackendPool
+	pathRoutes []pathRoute // longest prefix first
+	mdServer string
+	resolved map[string]*BackendPool
+	resolvedLock *sync.RWMutex
+	derived *DerivedRegistry
+	cache *RecordCache
+	chunkWindows int64 // zero if large requests are not split
+	parallelism int
+	prefetcher *Prefetcher // nil if prefetching is disabled
+	limits *QueryLimits
+	auth *Authenticator
+	usage *StreamCounter
+}
+
+/** Creates a new Router.
+	pools - the backend pools, keyed by name.
+	routing - the routing rules; if nil, everything goes to the only pool.
+	mdServer - the metadata server used to look up the Path of a stream.
+	derived - the derived streams, which are computed from the streams they
+		refer to instead of being routed to a backend.
+	cache - the cache for transformed results. */
+func NewRouter(pools map[string]*BackendPool, routing *RoutingConfig, mdServer string, derived *DerivedRegistry, cache *RecordCache) (*Router, error) {
+	var rt *Router = &Router{
+		pools: pools,
+		uuidRoutes: make(map[string]*BackendPool),
+		pathRoutes: make([]pathRoute, 0),
+		mdServer: mdServer,
+		resolved: make(map[string]*BackendPool),
+		resolvedLock: &sync.RWMutex{},
+		derived: derived,
+		cache: cache,
+		usage: NewStreamCounter(),
+	}
+	
+	if routing == nil {
+		if len(pools) != 1 {
+			return nil, fmt.Errorf("A routing file is required when more than one backend is configured")
+		}
+		for _, pool := range pools {
+			rt.defaultPool = pool
+		}
+		return rt, nil
+	}
+	
+	var ok bool
+	rt.defaultPool, ok = pools[routing.Default]
+	if !ok {
+		return nil, fmt.Errorf("Default backend \"%v\" is not configured", routing.Default)
+	}
+	
+	for prefix, name := range routing.Paths {
+		pool, ok := pools[name]
+		if !ok {
+			return nil, fmt.Errorf("Backend \"%v\" for path prefix %v is not configured", name, prefix)
+		}
+		rt.pathRoutes = append(rt.pathRoutes, pathRoute{prefix: prefix, pool: pool})
+	}
+	sort.Slice(rt.pathRoutes, func (i int, j int) bool {
+		return len(rt.pathRoutes[i].prefix) > len(rt.pathRoutes[j].prefix)
+	})
+	
+	for uuidStr, name := range routing.Uuids {
+		pool, ok := pools[name]
+		if !ok {
+			return nil, fmt.Errorf("Backend \"%v\" for stream %v is not configured", name, uuidStr)
+		}
+		var parsed uuid.UUID = uuid.Parse(uuidStr)
+		if parsed == nil {
+			return nil, fmt.Errorf("Invalid UUID %v in routing file", uuidStr)
+		}
+		rt.uuidRoutes[parsed.String()] = pool
+	}
+	
+	return rt, nil
+}
+
+/** Reads a routing file in JSON format. */
+func LoadRoutingConfig(filename string) (*RoutingConfig, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var routing RoutingConfig
+	err = json.Unmarshal(contents, &routing)
+	if err != nil {
+		return nil, err
+	}
+	return &routing, nil
+}
+
+/** Returns the pool that serves each of the specified streams. Streams that
+	are not routed explicitly by UUID are routed by their Path, which is looked
+	up on the metadata server and then cached. */
+func (rt *Router) resolve(uuids []uuid.UUID) []*BackendPool {
+	var result []*BackendPool = make([]*BackendPool, len(uuids))
+	var unknown []string = make([]string, 0)
+	var i int
+	
+	rt.resolvedLock.RLock()
+	for i = 0; i < len(uuids); i++ {
+		var key string = uuids[i].String()
+		if pool, ok := rt.uuidRoutes[key]; ok {
+			result[i] = pool
+		} else if len(rt.pathRoutes) == 0 {
+			result[i] = rt.defaultPool
+		} else if pool, ok := rt.resolved[key]; ok {
+			result[i] = pool
+		} else {
+			unknown = append(unknown, key)
+		}
+	}
+	rt.resolvedLock.RUnlock()
+	
+	if len(unknown) != 0 {
+		paths, err := rt.lookupPaths(unknown)
+		if err != nil {
+			fmt.Printf("Could not look up paths of streams for routing: %v\n", err)
+		}
+		
+		rt.resolvedLock.Lock()
+		for _, key := range unknown {
+			path, ok := paths[key]
+			if !ok {
+				// Don't cache this; the metadata server may know about it later
+				continue
+			}
+			rt.resolved[key] = rt.routePath(path)
+		}
+		rt.resolvedLock.Unlock()
+		
+		for i = 0; i < len(uuids); i++ {
+			if result[i] == nil {
+				if path, ok := paths[uuids[i].String()]; ok {
+					result[i] = rt.routePath(path)
+				} else {
+					result[i] = rt.defaultPool
+				}
+			}
+		}
+	}
+	
+	return result
+}
+
+func (rt *Router) routePath(path string) *BackendPool {
+	for _, route := range rt.pathRoutes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.pool
+		}
+	}
+	return rt.defaultPool
+}
+
+/** Queries the metadata server for the Path of each of the specified
+	streams. */
+func (rt *Router) lookupPaths(uuidStrs []string) (map[string]string, error) {
+	var clauses []string = make([]string, len(uuidStrs))
+	for i, uuidStr := range uuidStrs {
+		clauses[i] = fmt.Sprintf("uuid = \"%v\"", uuidStr)
+	}
+	var query string = "select * where " + strings.Join(clauses, " or ")
+	
+	resp, err := http.Post(rt.mdServer + "?tags=all", "text", strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	
+	var docs []struct {
+		Uuid string `json:"uuid"`
+		Path string `json:"Path"`
+	}
+	err = json.Unmarshal(body, &docs)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse metadata response: %v", err)
+	}
+	
+	var paths map[string]string = make(map[string]string)
+	for _, doc := range docs {
+		paths[doc.Uuid] = doc.Path
+	}
+	return paths, nil
+}
+
+/** Sets the limits on requests served directly by the Router. */
+func (rt *Router) SetLimits(limits *QueryLimits) {
+	rt.limits = limits
+}
+
+/** Sets the Authenticator whose principals' tags decide which streams a
+	request may find by Path. */
+func (rt *Router) SetAuthenticator(auth *Authenticator) {
+	rt.auth = auth
+}
+
+/** Makes a request for data from whichever backend serves the stream, and
+	writes the result to the specified Writer. If the server chose the point
+	width, the result is wrapped in an object that also gives the point
+	width. Returns the error written, if any. */
+func (rt *Router) MakeDataRequest(req *DataRequest, writ Writable) error {
+	rt.usage.Count(req.Uuid.String())
+	if rt.shouldSplit(req) {
+		return rt.makeSplitDataRequest(req, writ)
+	}
+	records, err := rt.QueryData(req)
+	if err != nil {
+		recentErrors.Add("data", err)
+		w := writ.GetWriter()
+		w.Write([]byte(err.Error()))
+		return err
+	}
+	if req.AutoPointWidth {
+		// Tell the client which point width we chose
+		w := writ.GetWriter()
+		w.Write([]byte(fmt.Sprintf("{\"pw\":%v,\"data\":", req.PointWidth)))
+		formatStatRecords(records, w)
+		w.Write([]byte("}"))
+		return nil
+	}
+	writeStatRecords(records, writ)
+	return nil
+}
+
+/** Like MakeDataRequest, but for requests large enough to be split into
+	chunks, which are streamed to the Writer as they complete. */
+func (rt *Router) makeSplitDataRequest(req *DataRequest, writ Writable) error {
+	var width int64 = req.WindowWidth()
+	var chunks []queryChunk = planChunks(req.StartTime, req.EndTime, width, rt.chunkWindows)
+	var prefix string = ""
+	var suffix string = ""
+	if req.AutoPointWidth {
+		prefix = fmt.Sprintf("{\"pw\":%v,\"data\":", req.PointWidth)
+		suffix = "}"
+	}
+	
+	w := writ.GetWriter()
+	written, err := rt.streamChunks(req.Uuid, chunks, width, prefix, suffix, w)
+	if err != nil {
+		recentErrors.Add("data", err)
+	}
+	if err != nil && !written {
+		w.Write([]byte(err.Error()))
+	}
+	return err
+}
+
+/** Obtains the records described by a request for data, summarized either by
+	point width or by calendar period, and passed through its pipeline. Plain
+	requests by point width have their neighbours prefetched. */
+func (rt *Router) QueryData(req *DataRequest) ([]StatRecord, error) {
+	if req.Rollup != nil {
+		return rt.QueryRollup(req.Uuid, req.StartTime, req.EndTime, req.Rollup)
+	}
+	records, err := rt.QueryPipeline(req.Uuid, req.StartTime, req.EndTime, req.WindowWidth(), req.Pipeline)
+	if err == nil && req.Width == 0 && len(req.Pipeline) == 0 {
+		rt.prefetcher.Schedule(req.Uuid, req.StartTime, req.EndTime, req.PointWidth)
+	}
+	return records, err
+}
+
+/** Obtains statistical records in windows of WIDTH nanoseconds beginning at
+	STARTTIME. Power-of-two windows aligned to their width are served with a
+	statistical query; any others with a windowed query. */
+func (rt *Router) QueryWidth(uuidBytes uuid.UUID, startTime int64, endTime int64, width int64) ([]StatRecord, error) {
+	if width > 0 && width & (width - 1) == 0 {
+		var pw uint8 = pointWidthForStep(width)
+		if (startTime >> pw) << pw == startTime {
+			return rt.QueryStatisticalValues(uuidBytes, startTime, endTime, pw)
+		}
+	}
+	return rt.QueryWindowValues(uuidBytes, startTime, endTime, width)
+}
+
+/** Obtains statistical records for the specified stream from whichever
+	backend serves it. Derived streams are evaluated from their inputs, which
+	are queried in parallel. Ranges that were prefetched are served from the
+	cache. */
+func (rt *Router) QueryStatisticalValues(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8) ([]StatRecord, error) {
+	var ds *DerivedStream = rt.derived.Lookup(uuidBytes)
+	if ds == nil {
+		if records, ok := rt.prefetcher.Lookup(uuidBytes, startTime, endTime, pw); ok {
+			return records, nil
+		}
+		var pool *BackendPool = rt.resolve([]uuid.UUID{uuidBytes})[0]
+		return pool.backend.QueryStatisticalValues(uuidBytes, startTime, endTime, pw)
+	}
+	return rt.evaluateDerived(ds, func (input uuid.UUID) ([]StatRecord, error) {
+		return rt.QueryStatisticalValues(input, startTime, endTime, pw)
+	})
+}
+
+/** Like QueryStatisticalValues, but in windows of exactly WIDTH nanoseconds,
+	served by a windowed query. */
+func (rt *Router) QueryWindowValues(uuidBytes uuid.UUID, startTime int64, endTime int64, width int64) ([]StatRecord, error) {
+	var ds *DerivedStream = rt.derived.Lookup(uuidBytes)
+	if ds == nil {
+		var pool *BackendPool = rt.resolve([]uuid.UUID{uuidBytes})[0]
+		return pool.backend.QueryWindowValues(uuidBytes, startTime, endTime, uint64(width))
+	}
+	return rt.evaluateDerived(ds, func (input uuid.UUID) ([]StatRecord, error) {
+		return rt.QueryWindowValues(input, startTime, endTime, width)
+	})
+}
+
+/** Obtains the points of a stream from whichever backend serves it. Derived
+	streams are only defined in terms of statistical records, so they have no
+	points. */
+func (rt *Router) QueryRawValues(uuidBytes uuid.UUID, startTime int64, endTime int64) ([]Point, error) {
+	if rt.derived.Lookup(uuidBytes) != nil {
+		return nil, fmt.Errorf("Derived stream %v has no raw values", uuidBytes.String())
+	}
+	var pool *BackendPool = rt.resolve([]uuid.UUID{uuidBytes})[0]
+	return pool.backend.QueryRawValues(uuidBytes, startTime, endTime)
+}
+
+/** Queries the inputs of a derived stream in parallel with QUERY, and
+	evaluates the stream from them. */
+func (rt *Router) evaluateDerived(ds *DerivedStream, query func (uuid.UUID) ([]StatRecord, error)) ([]StatRecord, error) {
+	var records [][]StatRecord = make([][]StatRecord, len(ds.Inputs))
+	var errs []error = make([]error, len(ds.Inputs))
+	var wg sync.WaitGroup
+	for i, input := range ds.Inputs {
+		wg.Add(1)
+		go func (i int, input uuid.UUID) {
+			defer wg.Done()
+			records[i], errs[i] = query(input)
+		}(i, input)
+	}
+	wg.Wait()
+	
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("Could not evaluate input %v of derived stream: %v", ds.Inputs[i].String(), err)
+		}
+	}
+	
+	return ds.Evaluate(records), nil
+}
+
+/** Makes a bracket request, querying each backend for the streams it serves
+	in parallel, and writes the merged result to the specified Writer. Returns
+	the error written, if any. */
+func (rt *Router) MakeBracketRequest(uuids []uuid.UUID, writ Writable) error {
+	brackets, err := rt.QueryBrackets(uuids)
+	if err != nil {
+		recentErrors.Add("bracket", err)
+		w := writ.GetWriter()
+		w.Write([]byte(err.Error()))
+		return err
+	}
+	writeBrackets(uuids, brackets, writ)
+	return nil
+}
+
+/** Obtains the earliest and latest point of each of the specified streams.
+	A derived stream is defined where all of its inputs are, so its left
+	boundary is the latest left boundary of its inputs and its right boundary
+	is the earliest right boundary. */
+func (rt *Router) QueryBrackets(uuids []uuid.UUID) ([]Bracket, error) {
+	var stored []uuid.UUID = make([]uuid.UUID, 0, len(uuids))
+	var storedIndices []int = make([]int, 0, len(uuids))
+	var derivedIndices []int = make([]int, 0)
+	for i, id := range uuids {
+		if rt.derived.Lookup(id) == nil {
+			stored = append(stored, id)
+			storedIndices = append(storedIndices, i)
+		} else {
+			derivedIndices = append(derivedIndices, i)
+		}
+	}
+	
+	var brackets []Bracket = make([]Bracket, len(uuids))
+	
+	if len(stored) != 0 {
+		storedBrackets, err := rt.queryStoredBrackets(stored)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range storedIndices {
+			brackets[i] = storedBrackets[j]
+		}
+	}
+	
+	for _, i := range derivedIndices {
+		var ds *DerivedStream = rt.derived.Lookup(uuids[i])
+		inputBrackets, err := rt.QueryBrackets(ds.Inputs)
+		if err != nil {
+			return nil, err
+		}
+		brackets[i] = Bracket{Left: QUASAR_LOW, Right: QUASAR_HIGH}
+		for _, input := range inputBrackets {
+			if input.Left == INVALID_TIME || input.Right == INVALID_TIME {
+				brackets[i] = Bracket{Left: INVALID_TIME, Right: INVALID_TIME}
+				break
+			}
+			if input.Left > brackets[i].Left {
+				brackets[i].Left = input.Left
+			}
+			if input.Right < brackets[i].Right {
+				brackets[i].Right = input.Right
+			}
+		}
+	}
+	
+	return brackets, nil
+}
+
+/** Obtains the brackets of streams stored in the backends, querying each
+	backend for the streams it serves in parallel. */
+func (rt *Router) queryStoredBrackets(uuids []uuid.UUID) ([]Bracket, error) {
+	var pools []*BackendPool = rt.resolve(uuids)
+	
+	var groups map[*BackendPool][]int = make(map[*BackendPool][]int)
+	for i, pool := range pools {
+		groups[pool] = append(groups[pool], i)
+	}
+	
+	if len(groups) == 1 {
+		return pools[0].backend.QueryBrackets(uuids)
+	}
+	
+	var brackets []Bracket = make([]Bracket, len(uuids))
+	var errs []error = make([]error, 0)
+	var errLock *sync.Mutex = &sync.Mutex{}
+	var wg sync.WaitGroup
+	
+	for pool, indices := range groups {
+		wg.Add(1)
+		go func (pool *BackendPool, indices []int) {
+			defer wg.Done()
+			var subset []uuid.UUID = make([]uuid.UUID, len(indices))
+			for j, index := range indices {
+				subset[j] = uuids[index]
+			}
+			subBrackets, err := pool.backend.QueryBrackets(subset)
+			if err != nil {
+				errLock.Lock()
+				errs = append(errs, fmt.Errorf("Backend %v: %v", pool.name, err))
+				errLock.Unlock()
+				return
+			}
+			for j, index := range indices {
+				brackets[index] = subBrackets[j]
+			}
+		}(pool, indices)
+	}
+	
+	wg.Wait()
+	
+	if len(errs) != 0 {
+		return nil, errs[0]
+	}
+	
+	return brackets, nil
+}
+
+/** Creates a BackendPool for each of the specified names. Backend NAME is
+	configured by the keys that begin with backend_NAME_, such as
+	backend_NAME_type and backend_NAME_addr. */
+func NewBackendPools(config map[string]interface{}, names []string, dataConn int, bracketConn int) (map[string]*BackendPool, error) {
+	var pools map[string]*BackendPool = make(map[string]*BackendPool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if _, ok := pools[name]; ok {
+			return nil, fmt.Errorf("Backend \"%v\" is listed more than once", name)
+		}
+		
+		backend, err := NewBackend(config, "backend_" + name + "_", dataConn, bracketConn)
+		if err != nil {
+			return nil, fmt.Errorf("Could not set up backend \"%v\": %v", name, err)
+		}
+		pools[name] = &BackendPool{name: name, backend: backend}
+	}
+	return pools, nil
+}
+
+/** Reads an integer from the configuration, returning DEFAULTVAL if the key
+	is absent. */
+func optionalIntConfig(config map[string]interface{}, key string, defaultVal int) (int, error) {
+	raw, ok := config[key]
+	if !ok {
+		return defaultVal, nil
+	}
+	val, err := strconv.ParseInt(raw.(string), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Configuration file must specify %v as an int", key)
+	}
+	return int(val), nil
+}
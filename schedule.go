@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/** Once a budget tracks this many clients, it forgets those that have been
+	idle long enough for their buckets to refill. */
+const BUCKET_SWEEP_SIZE int = 4096
+
+/** The longest a WebSocket request is held back to respect its client's rate
+	limit before it is refused instead. */
+const MAX_THROTTLE_WAIT time.Duration = 5 * time.Second
+
+/** A token bucket holding up to a budget's burst of tokens, refilled at its
+	rate. Each request takes one token. */
+type tokenBucket struct {
+	tokens float64
+	updated time.Time
+}
+
+/** A Budget limits one class of traffic, such as interactive plotting or bulk
+	export. Each client, identified by user if it authenticated and by IP
+	address, as reported by any trusted proxies, otherwise, may make RATE requests per second on average, with
+	bursts of up to BURST. At most SLOTS requests in the class are served at
+	once; when more are waiting, the slots go to the waiting clients in turn,
+	so that one client with many requests cannot starve the others. */
+type Budget struct {
+	name string
+	rate float64 // zero if requests are not rate limited
+	burst float64
+	buckets map[string]*tokenBucket
+	bucketLock *sync.Mutex
+	scheduler *FairScheduler
+	auth *Authenticator
+	proxies *ProxyPolicy
+}
+
+/** Creates a Budget named NAME whose settings are read from the keys
+	NAME_rate, NAME_burst and NAME_slots of the configuration file. */
+func LoadBudget(config map[string]interface{}, name string, rate int, burst int, slots int, auth *Authenticator, proxies *ProxyPolicy) (*Budget, error) {
+	rate, err := optionalIntConfig(config, name + "_rate", rate)
+	if err != nil {
+		return nil, err
+	}
+	burst, err = optionalIntConfig(config, name + "_burst", burst)
+	if err != nil {
+		return nil, err
+	}
+	slots, err = optionalIntConfig(config, name + "_slots", slots)
+	if err != nil {
+		return nil, err
+	}
+	if rate < 0 || burst < 1 || slots < 1 {
+		return nil, fmt.Errorf("Configuration file must specify a nonnegative %v_rate and positive %v_burst and %v_slots", name, name, name)
+	}
+	return &Budget{
+		name: name,
+		rate: float64(rate),
+		burst: float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		bucketLock: &sync.Mutex{},
+		scheduler: NewFairScheduler(slots),
+		auth: auth,
+		proxies: proxies,
+	}, nil
+}
+
+/** Identifies the client that made a request. */
+func (b *Budget) Client(r *http.Request) string {
+	if p := b.auth.Authenticate(r); p != nil {
+		return "user:" + p.User
+	}
+	return "ip:" + b.proxies.ClientAddress(r)
+}
+
+/** Takes a token from the client's bucket. If the bucket is empty, returns
+	false and how long it will be until a token is available. */
+func (b *Budget) Take(client string) (bool, time.Duration) {
+	if b.rate == 0 {
+		return true, 0
+	}
+	var now time.Time = time.Now()
+	
+	b.bucketLock.Lock()
+	defer b.bucketLock.Unlock()
+	
+	if len(b.buckets) >= BUCKET_SWEEP_SIZE {
+		var refill time.Duration = time.Duration(b.burst / b.rate * float64(time.Second))
+		for key, bucket := range b.buckets {
+			if now.Sub(bucket.updated) > refill {
+				delete(b.buckets, key)
+			}
+		}
+	}
+	
+	bucket, ok := b.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: b.burst, updated: now}
+		b.buckets[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * b.rate
+	if bucket.tokens > b.burst {
+		bucket.tokens = b.burst
+	}
+	bucket.updated = now
+	
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / b.rate * float64(time.Second))
+	}
+	bucket.tokens -= 1
+	return true, 0
+}
+
+/** Like Take, but waits for a token if one will be available soon. Used for
+	WebSocket requests, which a plot would rather have late than not at all. */
+func (b *Budget) Throttle(client string) *LimitError {
+	for {
+		ok, wait := b.Take(client)
+		if ok {
+			return nil
+		}
+		if wait > MAX_THROTTLE_WAIT {
+			return b.rateError(wait)
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (b *Budget) rateError(wait time.Duration) *LimitError {
+	return &LimitError{
+		Message: fmt.Sprintf("Too many %v requests; try again in %v", b.name, wait),
+		Limit: b.name + "_rate",
+		Max: int64(b.rate),
+		status: http.StatusTooManyRequests,
+	}
+}
+
+/** Waits for the client's turn to be served. The caller must call Release when
+	done. */
+func (b *Budget) Acquire(client string) {
+	b.scheduler.Acquire(client)
+}
+
+func (b *Budget) Release() {
+	b.scheduler.Release()
+}
+
+/** Wraps a handler so that requests are refused once their client exceeds its
+	rate, and otherwise wait their turn to be served. */
+func (b *Budget) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		var client string = b.Client(r)
+		ok, wait := b.Take(client)
+		if !ok {
+			var seconds int64 = int64(wait / time.Second) + 1
+			w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+			var lerr *LimitError = b.rateError(wait)
+			writeJSON(w, lerr.status, lerr)
+			return
+		}
+		b.Acquire(client)
+		defer b.Release()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+/** A FairScheduler admits at most a fixed number of requests at once. Waiting
+	requests are admitted one client at a time, in round-robin order, and in
+	the order they arrived for each client. */
+type FairScheduler struct {
+	capacity int
+	active int
+	queues map[string][]chan bool
+	turns []string // clients with waiting requests, next to be served first
+	lock *sync.Mutex
+}
+
+func NewFairScheduler(capacity int) *FairScheduler {
+	return &FairScheduler{
+		capacity: capacity,
+		active: 0,
+		queues: make(map[string][]chan bool),
+		turns: make([]string, 0),
+		lock: &sync.Mutex{},
+	}
+}
+
+/** Waits until a request by CLIENT may be served. */
+func (fs *FairScheduler) Acquire(client string) {
+	fs.lock.Lock()
+	if fs.active < fs.capacity && len(fs.turns) == 0 {
+		fs.active++
+		fs.lock.Unlock()
+		return
+	}
+	var admitted chan bool = make(chan bool, 1)
+	if len(fs.queues[client]) == 0 {
+		fs.turns = append(fs.turns, client)
+	}
+	fs.queues[client] = append(fs.queues[client], admitted)
+	fs.lock.Unlock()
+	<-admitted
+}
+
+/** Marks a request as served, handing its slot to the next waiting client. */
+func (fs *FairScheduler) Release() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if len(fs.turns) == 0 {
+		fs.active--
+		return
+	}
+	var client string = fs.turns[0]
+	fs.turns = fs.turns[1:]
+	var queue []chan bool = fs.queues[client]
+	if len(queue) > 1 {
+		fs.queues[client] = queue[1:]
+		fs.turns = append(fs.turns, client)
+	} else {
+		delete(fs.queues, client)
+	}
+	queue[0] <- true
+}
+
+/** Returns the number of requests being served and the number waiting. */
+func (fs *FairScheduler) Load() (int, int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var waiting int = 0
+	for _, queue := range fs.queues {
+		waiting += len(queue)
+	}
+	return fs.active, waiting
+}
@@ -1,83 +1,36 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 	
 	cparse "github.com/SoftwareDefinedBuildings/sync2_quasar/configparser"
-	cpint "github.com/SoftwareDefinedBuildings/quasar/cpinterface"
-	capnp "github.com/glycerine/go-capnproto"
+	quasar "github.com/SoftwareDefinedBuildings/webgl-plotter/quasar"
 	ws "github.com/gorilla/websocket"
 	uuid "code.google.com/p/go-uuid/uuid"
 )
 
 const (
-	QUASAR_LOW int64 = 1 - (16 << 56)
-	QUASAR_HIGH int64 = (48 << 56) - 1
-	INVALID_TIME int64 = -0x8000000000000000
+	QUASAR_LOW int64 = quasar.MIN_TIME
+	QUASAR_HIGH int64 = quasar.MAX_TIME
+	INVALID_TIME int64 = quasar.INVALID_TIME
 )
 
-var upgrader = ws.Upgrader{}
-
-func splitTime(time int64) (millis int64, nanos int32) {
-	millis = time / 1000000
-	nanos = int32(time % 1000000)
-	if nanos < 0 {
-		nanos += 1000000
-		millis++
-	}
-	return
-}
-
-type QueryMessagePart struct {
-	segment *capnp.Segment
-	request *cpint.Request
-	query *cpint.CmdQueryStatisticalValues
-}
-
-var queryPool sync.Pool = sync.Pool{
-	New: func () interface{} {
-		var seg *capnp.Segment = capnp.NewBuffer(nil)
-		var req cpint.Request = cpint.NewRootRequest(seg)
-		var query cpint.CmdQueryStatisticalValues = cpint.NewCmdQueryStatisticalValues(seg)
-		query.SetVersion(0)
-		return QueryMessagePart{
-			segment: seg,
-			request: &req,
-			query: &query,
-		}
-	},
-}
-
-type BracketMessagePart struct {
-	segment *capnp.Segment
-	request *cpint.Request
-	bquery *cpint.CmdQueryNearestValue
-}
+/** The records and brackets of the QUASAR client are used throughout. */
+type StatRecord = quasar.StatRecord
+type Bracket = quasar.Bracket
 
-var bracketPool sync.Pool = sync.Pool{
-	New: func () interface{} {
-		var seg *capnp.Segment = capnp.NewBuffer(nil)
-		var req cpint.Request = cpint.NewRootRequest(seg)
-		var bquery cpint.CmdQueryNearestValue = cpint.NewCmdQueryNearestValue(seg)
-		bquery.SetVersion(0)
-		return BracketMessagePart{
-			segment: seg,
-			request: &req,
-			bquery: &bquery,
-		}
-	},
-}
+var upgrader = ws.Upgrader{}
 
 type Writable interface {
 	GetWriter () io.Writer
@@ -91,6 +44,19 @@ func (rw RespWrapper) GetWriter() io.Writer {
 	return rw.wr
 }
 
+/** Writes V to the response as JSON with the specified status code. */
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Could not encode response: %v", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
 type ConnWrapper struct {
 	Writing *sync.Mutex
 	Conn *ws.Conn
@@ -109,273 +75,40 @@ func (cw *ConnWrapper) GetWriter() io.Writer {
 	}
 }
 
-/** DataRequester encapsulates a series of connections used for obtaining data
-	from QUASAR. */
-type DataRequester struct {
-	connections []net.Conn
-	sendLocks []*sync.Mutex
-	currID uint64
-	connID uint32
-	pending uint32
-	maxPending uint32
-	pendingLock *sync.Mutex
-	responseWriters map[uint64]Writable
-	synchronizers map[uint64]chan bool
-	boundaries map[uint64]int64
-	alive bool
+/** Writes statistical records in the format expected by the plotter: an
+	array of [millis, nanos, min, mean, max, count] arrays. */
+func writeStatRecords(records []StatRecord, writ Writable) {
+	w := writ.GetWriter()
+	formatStatRecords(records, w)
 }
 
-/** Creates a new DataRequester object.
-	dbAddr - the address of the database from where to obtain data.
-	numConnections - the number of connections to use.
-	maxPending - a limit on the maximum number of pending requests.
-	bracket - whether or not the new DataRequester will be used for bracket calls. */
-func NewDataRequester(dbAddr string, numConnections int, maxPending uint32, bracket bool) *DataRequester {
-	var connections []net.Conn = make([]net.Conn, numConnections)
-	var locks []*sync.Mutex = make([]*sync.Mutex, numConnections)
-	var err error
-	var i int
-	for i = 0; i < numConnections; i++ {
-		connections[i], err = net.Dial("tcp", dbAddr)
-		if err != nil {
-			fmt.Printf("Could not connect to database at %v: %v\n", dbAddr, err)
-			return nil
-		}
-		locks[i] = &sync.Mutex{}
-	}
-	
-	var dr *DataRequester = &DataRequester{
-		connections: connections,
-		sendLocks: locks,
-		currID: 0,
-		connID: 0,
-		pending: 0,
-		maxPending: maxPending,
-		pendingLock: &sync.Mutex{},
-		responseWriters: make(map[uint64]Writable),
-		synchronizers: make(map[uint64]chan bool),
-		boundaries: make(map[uint64]int64),
-		alive: true,
-	}
-	
-	var responseHandler func(net.Conn)
-	if bracket {
-		responseHandler = dr.handleBracketResponse
+func formatStatRecords(records []StatRecord, w io.Writer) {
+	length := len(records)
+	if length == 0 {
+		w.Write([]byte("[]"))
 	} else {
-		responseHandler = dr.handleDataResponse
-	}
-	
-	for i = 0; i < numConnections; i++ {
-		go responseHandler(connections[i])
-	}
-	
-	return dr
-}
-
-/* Makes a request for data and writes the result to the specified Writer. */
-func (dr *DataRequester) MakeDataRequest(uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8, writ Writable) {
-	for true {
-		dr.pendingLock.Lock()
-		if dr.pending < dr.maxPending {
-			dr.pending += 1
-			dr.pendingLock.Unlock()
-			break
-		} else {
-			dr.pendingLock.Unlock()
-			time.Sleep(time.Second)
+		w.Write([]byte("["))
+		for i := 0; i < length; i++ {
+			formatStatRecord(&records[i], w)
+			if i < length - 1 {
+				w.Write([]byte(","))
+			} else {
+				w.Write([]byte("]"))
+			}
 		}
 	}
-	
-	defer atomic.AddUint32(&dr.pending, 0xFFFFFFFF)
-	
-	var mp QueryMessagePart = queryPool.Get().(QueryMessagePart)
-	
-	segment := mp.segment
-	request := mp.request
-	query := mp.query
-	
-	query.SetUuid([]byte(uuidBytes))
-	query.SetStartTime(startTime)
-	query.SetEndTime(endTime)
-	query.SetPointWidth(pw)
-	
-	id := atomic.AddUint64(&dr.currID, 1)
-	
-	request.SetEchoTag(id)
-	
-	request.SetQueryStatisticalValues(*query)
-	
-	cid := atomic.AddUint32(&dr.connID, 1) % uint32(len(dr.connections))
-	
-	dr.sendLocks[cid].Lock()
-	dr.responseWriters[id] = writ
-	dr.synchronizers[id] = make(chan bool)
-	_, sendErr := segment.WriteTo(dr.connections[cid])
-	dr.sendLocks[cid].Unlock()
-	
-	defer delete(dr.responseWriters, id)
-	defer delete(dr.synchronizers, id)
-	
-	queryPool.Put(mp)
-	
-	if sendErr != nil {
-		w := writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Could not send query to database: %v", sendErr)))
-		return
-	}
-	
-	<- dr.synchronizers[id]
 }
 
-/** A function designed to handle QUASAR's response over Cap'n Proto.
-	You shouldn't ever have to invoke this function. It is used internally by
-	the constructor function. */
-func (dr *DataRequester) handleDataResponse(connection net.Conn) {
-	for dr.alive {
-		// Only one goroutine will be reading at a time, so a lock isn't needed
-		responseSegment, respErr := capnp.ReadFromStream(connection, nil)
-		
-		if respErr != nil {
-			if !dr.alive {
-				break
-			}
-			fmt.Printf("Error in receiving response: %v\n", respErr)
-			continue
-		}
-		
-		responseSeg := cpint.ReadRootResponse(responseSegment)
-		id := responseSeg.EchoTag()
-		status := responseSeg.StatusCode()
-		records := responseSeg.StatisticalRecords().Values()
-		
-		writ := dr.responseWriters[id]
-		
-		w := writ.GetWriter()
-		
-		if status != cpint.STATUSCODE_OK {
-			w.Write([]byte(fmt.Sprintf("Database returns status code %v", status)))
-			dr.synchronizers[id] <- false
-			continue
-		}
-		
-		length := records.Len()
-		if length == 0 {
-			w.Write([]byte("[]"))
-		} else {
-			w.Write([]byte("["))
-			for i := 0; i < length; i++ {
-				record := records.At(i)
-				millis, nanos := splitTime(record.Time())
-				if i < length - 1 {
-					w.Write([]byte(fmt.Sprintf("[%v,%v,%v,%v,%v,%v],", millis, nanos, record.Min(), record.Mean(), record.Max(), record.Count())))
-				} else {
-					w.Write([]byte(fmt.Sprintf("[%v,%v,%v,%v,%v,%v]]", millis, nanos, record.Min(), record.Mean(), record.Max(), record.Count())))
-				}
-			}
-		}
-		
-		dr.synchronizers[id] <- true
-	}
+func formatStatRecord(record *StatRecord, w io.Writer) {
+	millis, nanos := quasar.SplitTime(record.Time)
+	w.Write([]byte(fmt.Sprintf("[%v,%v,%v,%v,%v,%v]", millis, nanos, record.Min, record.Mean, record.Max, record.Count)))
 }
 
-func (dr *DataRequester) MakeBracketRequest(uuids []uuid.UUID, writ Writable) {
-	for true {
-		dr.pendingLock.Lock()
-		if dr.pending < dr.maxPending {
-			dr.pending += 1
-			dr.pendingLock.Unlock()
-			break
-		} else {
-			dr.pendingLock.Unlock()
-			time.Sleep(time.Second)
-		}
-	}
-	
-	defer atomic.AddUint32(&dr.pending, 0xFFFFFFFF)
-	
-	var mp BracketMessagePart = bracketPool.Get().(BracketMessagePart)
-	
-	segment := mp.segment
-	request := mp.request
-	bquery := mp.bquery
-	
-	var numResponses int = 2 * len(uuids)
-	var responseChan chan bool = make(chan bool, numResponses)
-	
-	var idsUsed []uint64 = make([]uint64, numResponses) // Due to concurrency, we could use a non-contiguous block of IDs
-	
-	var i int
-	var id uint64
-	var cid uint32
-	var sendErr error
-	for i = 0; i < len(uuids); i++ {
-		bquery.SetUuid([]byte(uuids[i]))
-		bquery.SetTime(QUASAR_LOW)
-		bquery.SetBackward(false)
-	
-		id = atomic.AddUint64(&dr.currID, 1)
-		idsUsed[i << 1] = id
-		dr.boundaries[id] = INVALID_TIME
-	
-		request.SetEchoTag(id)
-	
-		request.SetQueryNearestValue(*bquery)
-	
-		cid = atomic.AddUint32(&dr.connID, 1) % uint32(len(dr.connections))
-	
-		dr.sendLocks[cid].Lock()
-		dr.responseWriters[id] = writ
-		dr.synchronizers[id] = responseChan
-		_, sendErr = segment.WriteTo(dr.connections[cid])
-		dr.sendLocks[cid].Unlock()
-		
-		defer delete(dr.responseWriters, id)
-		defer delete(dr.synchronizers, id)
-		defer delete(dr.boundaries, id)
-		
-		if sendErr != nil {
-			w := writ.GetWriter()
-			w.Write([]byte(fmt.Sprintf("Could not send query to database: %v", sendErr)))
-			return
-		}
-		
-		bquery.SetTime(QUASAR_HIGH)
-		bquery.SetBackward(true)
-		
-		id = atomic.AddUint64(&dr.currID, 1)
-		idsUsed[(i << 1) + 1] = id
-		dr.boundaries[id] = INVALID_TIME
-	
-		request.SetEchoTag(id)
-	
-		request.SetQueryNearestValue(*bquery)
-	
-		cid = atomic.AddUint32(&dr.connID, 1) % uint32(len(dr.connections))
-	
-		dr.sendLocks[cid].Lock()
-		dr.responseWriters[id] = writ
-		dr.synchronizers[id] = responseChan
-		_, sendErr = segment.WriteTo(dr.connections[cid])
-		dr.sendLocks[cid].Unlock()
-		
-		defer delete(dr.responseWriters, id)
-		defer delete(dr.synchronizers, id)
-		defer delete(dr.boundaries, id)
-		
-		if sendErr != nil {
-			w := writ.GetWriter()
-			w.Write([]byte(fmt.Sprintf("Could not send query to database: %v", sendErr)))
-			return
-		}
-	}
-	
-	bracketPool.Put(mp)
-	
-	for i = 0; i < numResponses; i++ {
-		<- responseChan
-	}
-	
+/** Writes the response to a bracket request, given the bracket of each
+	stream. */
+func writeBrackets(uuids []uuid.UUID, brackets []Bracket, writ Writable) {
 	var (
+		i int
 		boundary int64
 		lNanos int32
 		lMillis int64
@@ -387,63 +120,65 @@ func (dr *DataRequester) MakeBracketRequest(uuids []uuid.UUID, writ Writable) {
 	w := writ.GetWriter()
 	w.Write([]byte("{"))
 	for i = 0; i < len(uuids); i++ {
-		boundary = dr.boundaries[idsUsed[i << 1]]
+		boundary = brackets[i].Left
 		if boundary < lowest {
 			lowest = boundary
 		}
-		lMillis, lNanos = splitTime(boundary)
-		boundary = dr.boundaries[idsUsed[(i << 1) + 1]]
+		lMillis, lNanos = quasar.SplitTime(boundary)
+		boundary = brackets[i].Right
 		if boundary > highest {
 			highest = boundary
 		}
-		rMillis, rNanos = splitTime(boundary)
+		rMillis, rNanos = quasar.SplitTime(boundary)
 		w.Write([]byte(fmt.Sprintf("\"%v\":[[%v,%v],[%v,%v]],", uuids[i].String(), lMillis, lNanos, rMillis, rNanos)))
 	}
-	lMillis, lNanos = splitTime(lowest)
-	rMillis, rNanos = splitTime(highest)
+	lMillis, lNanos = quasar.SplitTime(lowest)
+	rMillis, rNanos = quasar.SplitTime(highest)
 	w.Write([]byte(fmt.Sprintf("\"Merged\":[[%v,%v],[%v,%v]]}", lMillis, lNanos, rMillis, rNanos)))
 }
 
-/** A function designed to handle QUASAR's response over Cap'n Proto.
-	You shouldn't ever have to invoke this function. It is used internally by
-	the constructor function. */
-func (dr *DataRequester) handleBracketResponse(connection net.Conn) {
-	for dr.alive {
-		// Only one goroutine will be reading at a time, so a lock isn't needed
-		responseSegment, respErr := capnp.ReadFromStream(connection, nil)
-		
-		if respErr != nil {
-			if !dr.alive {
-				break
-			}
-			fmt.Printf("Error in receiving response: %v\n", respErr)
-			continue
+/** Splits a comma-separated list of database addresses. */
+func parseAddrList(addrs string) []string {
+	var result []string = make([]string, 0)
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			result = append(result, addr)
 		}
-		
-		responseSeg := cpint.ReadRootResponse(responseSegment)
-		id := responseSeg.EchoTag()
-		status := responseSeg.StatusCode()
-		records := responseSeg.Records().Values()
-		
-		if status != cpint.STATUSCODE_OK {
-			fmt.Printf("Error in bracket call: database returns status code %v\n", status)
-			dr.synchronizers[id] <- false
-			continue
-		}
-		
-		if records.Len() > 0 {
-			dr.boundaries[id] = records.At(0).Time()
-		}
-		
-		dr.synchronizers[id] <- true
 	}
+	return result
 }
 
-func (dr *DataRequester) stop() {
-	dr.alive = false
+/** A parsed request for data. The data is summarized in windows of width
+	2^PointWidth nanoseconds, in windows of exactly Width nanoseconds if Width
+	is not zero, or in calendar periods if Rollup is not nil. */
+type DataRequest struct {
+	Uuid uuid.UUID
+	StartTime int64
+	EndTime int64
+	PointWidth uint8
+	AutoPointWidth bool // whether the server chose the point width
+	Width int64
+	Rollup *Rollup
+	Pipeline Pipeline
 }
 
-func parseDataRequest(request string, writ Writable) (uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8, extra string, success bool) {
+/** Returns the width of the windows of the request, in nanoseconds. */
+func (req *DataRequest) WindowWidth() int64 {
+	if req.Width != 0 {
+		return req.Width
+	}
+	return int64(1) << req.PointWidth
+}
+
+/** Parses a request for data of the form "UUID,START,END,PW[,EXTRA]". The
+	UUID may be followed by a pipeline of transforms to apply, separated by
+	'|', as in "UUID|mean(10m)|derivative". Instead of a point width, PW may
+	be an exact window width with a unit, as in "1s" or "15m", name a
+	calendar period, as in "day" or "day@America/Los_Angeles", or give a
+	budget from which the server chooses the point width, as in "800px" for a
+	plot 800 pixels wide or "500pts" for at least 500 points. */
+func parseDataRequest(request string, writ Writable) (req *DataRequest, extra string, success bool) {
 	var args []string = strings.Split(string(request), ",")
 	var err error
 	
@@ -459,45 +194,120 @@ func parseDataRequest(request string, writ Writable) (uuidBytes uuid.UUID, start
 	if len(args) == 5 {
 		extra = args[4]
 	}
-
-	uuidBytes = uuid.Parse(args[0])
-
-	if uuidBytes == nil {
+	
+	req, err = newDataRequest(args[0], args[1], args[2], args[3])
+	if err != nil {
 		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Invalid UUID: got %v", args[0])))
+		w.Write([]byte(err.Error()))
 		return
 	}
-	var pwTemp int64
+	
+	success = true
+	
+	return
+}
 
-	startTime, err = strconv.ParseInt(args[1], 10, 64)
+/** Builds a request for data from its textual fields, aligning the range to
+	the resolution. */
+func newDataRequest(streamSpec string, startStr string, endStr string, resolution string) (*DataRequest, error) {
+	var req *DataRequest = &DataRequest{}
+	var err error
+	
+	var specParts []string = strings.SplitN(streamSpec, "|", 2)
+	req.Uuid = uuid.Parse(specParts[0])
+
+	if req.Uuid == nil {
+		return nil, fmt.Errorf("Invalid UUID: got %v", specParts[0])
+	}
+	
+	if len(specParts) == 2 {
+		req.Pipeline, err = ParsePipeline(specParts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid transform pipeline: %v", err)
+		}
+	}
+
+	req.StartTime, err = strconv.ParseInt(startStr, 10, 64)
 	if err != nil {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Could not interpret %v as an int64: %v", args[1], err)))
-		return
+		return nil, fmt.Errorf("Could not interpret %v as an int64: %v", startStr, err)
 	}
 
-	endTime, err = strconv.ParseInt(args[2], 10, 64)
+	req.EndTime, err = strconv.ParseInt(endStr, 10, 64)
 	if err != nil {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Could not interpret %v as an int64: %v", args[2], err)))
-		return
+		return nil, fmt.Errorf("Could not interpret %v as an int64: %v", endStr, err)
+	}
+	
+	if IsRollupSpec(resolution) {
+		req.Rollup, err = ParseRollup(resolution)
+		if err != nil {
+			return nil, err
+		}
+		if len(req.Pipeline) != 0 {
+			return nil, fmt.Errorf("Transforms cannot be applied to calendar rollups")
+		}
+		req.StartTime = req.Rollup.Floor(req.StartTime)
+		req.EndTime = req.Rollup.Next(req.Rollup.Floor(req.EndTime)) // the period containing the endtime is included
+		return req, nil
+	}
+
+	var budgetUnit string = "px"
+	if strings.HasSuffix(resolution, "pts") {
+		budgetUnit = "pts"
+	}
+	if strings.HasSuffix(resolution, budgetUnit) {
+		budget, err := strconv.ParseInt(strings.TrimSuffix(resolution, budgetUnit), 10, 64)
+		if err != nil || budget <= 0 {
+			return nil, fmt.Errorf("Could not interpret %v as a pixel or point budget", resolution)
+		}
+		if req.EndTime <= req.StartTime {
+			return nil, fmt.Errorf("A pixel or point budget requires a nonempty range")
+		}
+		req.PointWidth = pointWidthForBudget(req.StartTime, req.EndTime, budget)
+		req.AutoPointWidth = true
+		req.StartTime = ((req.StartTime >> req.PointWidth) << req.PointWidth)
+		req.EndTime = (((req.EndTime >> req.PointWidth) + 1) << req.PointWidth)
+		return req, nil
 	}
 
-	pwTemp, err = strconv.ParseInt(args[3], 10, 16)
+	pwTemp, err := strconv.ParseInt(resolution, 10, 16)
 	if err != nil {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Could not interpret %v as an int16: %v", args[3], err)))
-		return
+		width, durErr := time.ParseDuration(resolution)
+		if durErr != nil {
+			return nil, fmt.Errorf("Could not interpret %v as an int16 or a window width: %v", resolution, err)
+		}
+		if width <= 0 {
+			return nil, fmt.Errorf("Window width must be positive; got %v", resolution)
+		}
+		req.Width = width.Nanoseconds()
+		// Like the endtime of a point width query, the endtime is inclusive
+		req.EndTime = req.StartTime + ((req.EndTime - req.StartTime) / req.Width + 1) * req.Width
+		return req, nil
 	}
 
-	pw = uint8(pwTemp)
-	
-	startTime = ((startTime >> pw) << pw)
-	endTime = (((endTime >> pw) + 1) << pw) // we add one pointwidth to the endtime to simulate an inclusive endpoint
+	if pwTemp < 0 || pwTemp > 62 {
+		return nil, fmt.Errorf("Invalid point width %v", pwTemp)
+	}
+	var pw uint8 = uint8(pwTemp)
+	req.PointWidth = pw
 	
-	success = true
+	req.StartTime = ((req.StartTime >> pw) << pw)
+	req.EndTime = (((req.EndTime >> pw) + 1) << pw) // we add one pointwidth to the endtime to simulate an inclusive endpoint
 	
-	return
+	return req, nil
+}
+
+/** Chooses the point width for a range given a budget of pixels or points:
+	the widest windows such that there is at least one window per pixel. This
+	matches getPWExponent in utils.js. */
+func pointWidthForBudget(startTime int64, endTime int64, budget int64) uint8 {
+	// Halve both ends separately so that the span can't overflow
+	var span uint64 = uint64((endTime >> 1) - (startTime >> 1)) << 1
+	var perWindow uint64 = span / uint64(budget)
+	var pw uint8 = 0
+	for pw < 62 && (uint64(1) << (pw + 1)) <= perWindow {
+		pw++
+	}
+	return pw
 }
 
 func parseBracketRequest(request string, writ Writable, expectExtra bool) (uuids []uuid.UUID, extra string, success bool) {
@@ -555,12 +365,6 @@ func main() {
 		return
 	}
 	
-	dbaddr, ok := config["db_addr"]
-	if !ok {
-		fmt.Println("Configuration file is missing required key \"db_addr\"")
-		return
-	}
-	
 	dataConnRaw, ok := config["num_data_conn"]
 	if !ok {
 		fmt.Println("Configuration file is missing required key \"num_data_conn\"")
@@ -573,12 +377,6 @@ func main() {
 		return
 	}
 	
-	directory, ok := config["plotter_dir"]
-	if !ok {
-		fmt.Println("Configuration file is missing required key \"plotter_dir\"")
-		return
-	}
-	
 	mdServerRaw, ok := config["metadata_server"]
 	if !ok {
 		fmt.Println("Configuration file is missing required key \"metadata_server\"")
@@ -599,16 +397,295 @@ func main() {
 	var bracketConn int = int(bracketConn64)
 	var mdServer string = mdServerRaw.(string)
 	
-	var dr *DataRequester = NewDataRequester(dbaddr.(string), dataConn, 8, false)
-	if dr == nil {
-		os.Exit(1)
+	var pools map[string]*BackendPool
+	backendsRaw, ok := config["backends"]
+	if ok {
+		pools, err = NewBackendPools(config, strings.Split(backendsRaw.(string), ","), dataConn, bracketConn)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		backend, err := NewBackend(config, "db_", dataConn, bracketConn)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		pools = map[string]*BackendPool{"default": &BackendPool{name: "default", backend: backend}}
+	}
+	
+	var routing *RoutingConfig
+	routingFile, ok := config["routing_file"]
+	if ok {
+		routing, err = LoadRoutingConfig(routingFile.(string))
+		if err != nil {
+			fmt.Printf("Could not read routing file %v: %v\n", routingFile, err)
+			return
+		}
+	}
+	
+	rollupZone, ok := config["rollup_timezone"]
+	if ok {
+		defaultRollupZone, err = time.LoadLocation(rollupZone.(string))
+		if err != nil {
+			fmt.Printf("Could not load time zone %v: %v\n", rollupZone, err)
+			return
+		}
+	}
+	
+	var derived *DerivedRegistry = NewDerivedRegistry()
+	derivedFile, ok := config["derived_file"]
+	if ok {
+		err = derived.LoadFile(derivedFile.(string))
+		if err != nil {
+			fmt.Printf("Could not load derived streams from %v: %v\n", derivedFile, err)
+			return
+		}
+	}
+	
+	cacheSize, err := optionalIntConfig(config, "cache_records", 1 << 22)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	
+	router, err := NewRouter(pools, routing, mdServer, derived, NewRecordCache(cacheSize))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	
+	chunkWindows, err := optionalIntConfig(config, "query_chunk_windows", 1 << 16)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	parallelism, err := optionalIntConfig(config, "query_parallelism", dataConn)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	router.EnableSplitting(int64(chunkWindows), parallelism)
+	
+	prefetchWorkers, err := optionalIntConfig(config, "prefetch_workers", 1)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	router.EnablePrefetch(prefetchWorkers)
+	
+	var auth *Authenticator
+	tokensFile, ok := config["tokens_file"]
+	if ok {
+		auth, err = LoadAuthenticator(tokensFile.(string))
+		if err != nil {
+			fmt.Printf("Could not read tokens file %v: %v\n", tokensFile, err)
+			return
+		}
+	}
+	router.SetAuthenticator(auth)
+	
+	limits, err := LoadQueryLimits(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	router.SetLimits(limits)
+	
+	var proxies *ProxyPolicy
+	trustedProxies, ok := config["trusted_proxies"]
+	if ok {
+		proxies, err = NewProxyPolicy(trustedProxies.(string))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
-	var br *DataRequester = NewDataRequester(dbaddr.(string), bracketConn, 8, true)
-	if br == nil {
-		os.Exit(1)
+	
+	interactive, err := LoadBudget(config, "interactive", 20, 100, 8, auth, proxies)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	bulk, err := LoadBudget(config, "bulk", 1, 5, 2, auth, proxies)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	
+	var audit *AuditLog
+	auditDir, ok := config["audit_dir"]
+	if ok {
+		auditMaxSize, err := optionalIntConfig(config, "audit_max_size", 64 << 20)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		auditMaxFiles, err := optionalIntConfig(config, "audit_max_files", 0)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		audit, err = OpenAuditLog(auditDir.(string), int64(auditMaxSize), auditMaxFiles, auth)
+		if err != nil {
+			fmt.Printf("Could not open audit log in %v: %v\n", auditDir, err)
+			return
+		}
+		if auth != nil {
+			http.Handle("/audit", audit)
+		}
+	}
+	
+	var sockets *SocketRegistry = NewSocketRegistry()
+	adminAddr, ok := config["admin_addr"]
+	if ok {
+		if auth == nil {
+			fmt.Println("Configuration file must specify tokens_file to use admin_addr")
+			return
+		}
+		var adminMux *http.ServeMux = http.NewServeMux()
+		adminMux.Handle("/", NewMonitor(router, []*Budget{interactive, bulk}, sockets, auth))
+		go func () {
+			log.Fatal(http.ListenAndServe(adminAddr.(string), adminMux))
+		}()
 	}
 	
-	http.Handle("/", http.FileServer(http.Dir(directory.(string))))
+	compression, err := LoadCompression(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	compression.ConfigureUpgrader(&upgrader)
+	
+	var origins *OriginPolicy
+	allowedOrigins, ok := config["allowed_origins"]
+	if ok {
+		origins = NewOriginPolicy(allowedOrigins.(string))
+	}
+	origins.ConfigureUpgrader(&upgrader)
+	
+	if auth != nil {
+		http.HandleFunc("/csrf", auth.ServeCSRF)
+	}
+	
+	var derivedStore *DiskStore
+	derivedDir, ok := config["derived_dir"]
+	if ok {
+		derivedStore, err = NewDiskStore(derivedDir.(string))
+		if err != nil {
+			fmt.Printf("Could not open derived stream store at %v: %v\n", derivedDir, err)
+			return
+		}
+	}
+	maxDerived, err := optionalIntConfig(config, "max_derived_streams", 1000)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = derived.AllowDefinitions(auth, derivedStore, maxDerived)
+	if err != nil {
+		fmt.Printf("Could not load derived streams from %v: %v\n", derivedDir, err)
+		return
+	}
+	http.Handle("/derived", auth.RequireCSRF(derived))
+	http.Handle("/aligned", audit.Wrap("aligned", bulk.Wrap(http.HandlerFunc(router.ServeAligned))))
+	http.Handle("/aggregate", audit.Wrap("aggregate", bulk.Wrap(http.HandlerFunc(router.ServeAggregate))))
+	http.Handle("/export", audit.Wrap("export", bulk.Wrap(http.HandlerFunc(router.ServeExport))))
+	
+	permalinkDir, ok := config["permalink_dir"]
+	if ok {
+		permalinkStore, err := NewDiskStore(permalinkDir.(string))
+		if err != nil {
+			fmt.Printf("Could not open permalink store at %v: %v\n", permalinkDir, err)
+			return
+		}
+		maxPermalinks, err := optionalIntConfig(config, "max_permalinks", 100000)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		permalinks, err := NewPermalinkService(permalinkStore, auth, maxPermalinks)
+		if err != nil {
+			fmt.Printf("Could not load permalinks from %v: %v\n", permalinkDir, err)
+			return
+		}
+		http.Handle("/permalink", auth.RequireCSRF(permalinks))
+		http.Handle("/permalink/", auth.RequireCSRF(permalinks))
+	}
+	
+	workspaceDir, ok := config["workspace_dir"]
+	if ok {
+		if auth == nil {
+			fmt.Println("Configuration file must specify tokens_file to use workspace_dir")
+			return
+		}
+		workspaceStore, err := NewDiskStore(workspaceDir.(string))
+		if err != nil {
+			fmt.Printf("Could not open workspace store at %v: %v\n", workspaceDir, err)
+			return
+		}
+		var workspaces *WorkspaceService = NewWorkspaceService(workspaceStore, auth)
+		http.Handle("/workspaces", auth.RequireCSRF(workspaces))
+		http.Handle("/workspaces/", auth.RequireCSRF(workspaces))
+	}
+	
+	// The frontend is embedded, but may be served from disk during development
+	var frontend fs.FS = embeddedAssets
+	directory, ok := config["plotter_dir"]
+	if ok {
+		frontend = os.DirFS(directory.(string))
+	}
+	static, err := LoadStaticAssets(frontend)
+	if err != nil {
+		fmt.Printf("Could not load frontend: %v\n", err)
+		return
+	}
+	
+	clientDataConn, err := optionalIntConfig(config, "client_data_conn", 8)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	clientBracketConn, err := optionalIntConfig(config, "client_bracket_conn", 2)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	certFile, ok1 := config["cert_file"]
+	keyFile, ok2 := config["key_file"]
+	var secure bool = ok1 && ok2
+	forceSecure, ok := config["force_secure"]
+	if ok {
+		// For when TLS is terminated by a proxy in front of the plotter
+		forced, err := strconv.ParseBool(forceSecure.(string))
+		if err != nil {
+			fmt.Println("Configuration file must specify force_secure as true or false")
+			return
+		}
+		secure = secure || forced
+	}
+	var clientConfig *ClientConfig = &ClientConfig{
+		Secure: secure,
+		DataConnections: clientDataConn,
+		BracketConnections: clientBracketConn,
+		Features: map[string]bool{
+			"auth": auth != nil,
+			"permalinks": permalinkDir != nil,
+			"workspaces": workspaceDir != nil,
+			"compression": compression != nil,
+			"derived": true,
+			"aligned": true,
+			"aggregate": true,
+			"export": true,
+		},
+	}
+	backendURL, ok := config["backend_url"]
+	if ok {
+		clientConfig.Backend = backendURL.(string)
+	}
+	
+	http.Handle("/config.json", clientConfig)
+	http.Handle("/", compression.Wrap(static))
 	http.HandleFunc("/dataws", func (w http.ResponseWriter, r *http.Request) {
 		websocket, upgradeerr := upgrader.Upgrade(w, r, nil)
 		if upgradeerr != nil {
@@ -616,6 +693,10 @@ func main() {
 			w.Write([]byte(fmt.Sprintf("Could not upgrade HTTP connection to WebSocket: %v\n", upgradeerr)))
 			return
 		}
+		compression.ConfigureConn(websocket)
+		var client string = interactive.Client(r)
+		var socket *socketInfo = sockets.Open("dataws", client, principalName(auth.Authenticate(r)))
+		defer sockets.Close(socket)
 		
 		cw := ConnWrapper{
 			Writing: &sync.Mutex{},
@@ -628,16 +709,35 @@ func main() {
 			if err != nil {
 				return // Most likely the connection was closed
 			}
+			compression.PrepareMessage(websocket, UNKNOWN_SIZE)
+			socket.Count()
 			
-			uuidBytes, startTime, endTime, pw, echoTag, success := parseDataRequest(string(payload), &cw)
+			req, echoTag, success := parseDataRequest(string(payload), &cw)
 		
 			if success {
-				dr.MakeDataRequest(uuidBytes, startTime, endTime, uint8(pw), &cw)
+				var status int = http.StatusOK
+				var reqErr error
+				lerr := limits.Check(router.DataRequestCost(req))
+				if lerr == nil {
+					lerr = interactive.Throttle(client)
+				}
+				if lerr == nil {
+					interactive.Acquire(client)
+					reqErr = router.MakeDataRequest(req, &cw)
+					interactive.Release()
+				} else {
+					writeLimitError(lerr, &cw)
+					status = lerr.status
+				}
+				audit.RecordMessage("dataws", r, []uuid.UUID{req.Uuid}, req.StartTime, req.EndTime, status, reqErr)
+			} else {
+				audit.RecordMessage("dataws", r, nil, 0, 0, http.StatusBadRequest, nil)
 			}
 			if cw.CurrWriter != nil {
 				cw.CurrWriter.Close()
 			}
 			
+			compression.PrepareMessage(websocket, len(echoTag))
 			writer, err := websocket.NextWriter(ws.TextMessage)
 			if err != nil {
 				fmt.Println("Could not echo tag to client")
@@ -654,7 +754,7 @@ func main() {
 			cw.Writing.Unlock()
 		}
 	})
-	http.HandleFunc("/data", func (w http.ResponseWriter, r *http.Request) {
+	http.Handle("/data", origins.Wrap(audit.Wrap("data", interactive.Wrap(compression.WrapFunc(func (w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.Header().Set("Allow", "POST")
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -662,20 +762,22 @@ func main() {
 			return
 		}
 
-		// TODO: don't just read the whole thing in one go. Instead give up after a reasonably long limit.
-		payload, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+		payload, ok := limits.ReadBody(w, r)
+		if !ok {
+			return
 		}
 		
 		wrapper := RespWrapper{w}
 		
-		uuidBytes, startTime, endTime, pw, _, success := parseDataRequest(string(payload), wrapper)
-		
+		req, _, success := parseDataRequest(string(payload), wrapper)
 		if success {
-			dr.MakeDataRequest(uuidBytes, startTime, endTime, uint8(pw), wrapper)
+			noteAccess(r, []uuid.UUID{req.Uuid}, req.StartTime, req.EndTime)
 		}
-	})
+		
+		if success && limits.Admit(w, r, router.DataRequestCost(req)) {
+			noteError(r, router.MakeDataRequest(req, wrapper))
+		}
+	})))))
 	http.HandleFunc("/bracketws", func (w http.ResponseWriter, r *http.Request) {
 		websocket, upgradeerr := upgrader.Upgrade(w, r, nil)
 		if upgradeerr != nil {
@@ -683,6 +785,10 @@ func main() {
 			w.Write([]byte(fmt.Sprintf("Could not upgrade HTTP connection to WebSocket: %v\n", upgradeerr)))
 			return
 		}
+		compression.ConfigureConn(websocket)
+		var client string = interactive.Client(r)
+		var socket *socketInfo = sockets.Open("bracketws", client, principalName(auth.Authenticate(r)))
+		defer sockets.Close(socket)
 		
 		cw := ConnWrapper{
 			Writing: &sync.Mutex{},
@@ -695,16 +801,35 @@ func main() {
 			if err != nil {
 				return // Most likely the connection was closed
 			}
+			compression.PrepareMessage(websocket, UNKNOWN_SIZE)
+			socket.Count()
 			
 			uuids, echoTag, success := parseBracketRequest(string(payload), &cw, true)
 			
 			if success {
-				br.MakeBracketRequest(uuids, &cw)
+				var status int = http.StatusOK
+				var reqErr error
+				lerr := limits.Check(router.BracketCost(uuids))
+				if lerr == nil {
+					lerr = interactive.Throttle(client)
+				}
+				if lerr == nil {
+					interactive.Acquire(client)
+					reqErr = router.MakeBracketRequest(uuids, &cw)
+					interactive.Release()
+				} else {
+					writeLimitError(lerr, &cw)
+					status = lerr.status
+				}
+				audit.RecordMessage("bracketws", r, uuids, 0, 0, status, reqErr)
+			} else {
+				audit.RecordMessage("bracketws", r, nil, 0, 0, http.StatusBadRequest, nil)
 			}
 			if cw.CurrWriter != nil {
 				cw.CurrWriter.Close()
 			}
 			
+			compression.PrepareMessage(websocket, len(echoTag))
 			writer, err := websocket.NextWriter(ws.TextMessage)
 			if err != nil {
 				fmt.Println("Could not echo tag to client")
@@ -721,7 +846,7 @@ func main() {
 			cw.Writing.Unlock()
 		}
 	})
-	http.HandleFunc("/bracket", func (w http.ResponseWriter, r *http.Request) {
+	http.Handle("/bracket", origins.Wrap(audit.Wrap("bracket", interactive.Wrap(compression.WrapFunc(func (w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.Header().Set("Allow", "POST")
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -729,21 +854,23 @@ func main() {
 			return
 		}
 
-		// TODO: don't just read the whole thing in one go. Instead give up after a reasonably long limit.
-		payload, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+		payload, ok := limits.ReadBody(w, r)
+		if !ok {
+			return
 		}
 		
 		wrapper := RespWrapper{w}
 		
 		uuids, _, success := parseBracketRequest(string(payload), wrapper, false)
-		
 		if success {
-			br.MakeBracketRequest(uuids, wrapper)
+			noteAccess(r, uuids, 0, 0)
 		}
-	})
-	http.HandleFunc("/metadata", func (w http.ResponseWriter, r *http.Request) {
+		
+		if success && limits.Admit(w, r, router.BracketCost(uuids)) {
+			noteError(r, router.MakeBracketRequest(uuids, wrapper))
+		}
+	})))))
+	http.Handle("/metadata", origins.Wrap(audit.Wrap("metadata", compression.WrapFunc(func (w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.Header().Set("Allow", "POST")
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -751,9 +878,13 @@ func main() {
 			return
 		}
 		
-		request, err := ioutil.ReadAll(r.Body) // should probably limit the size of this
+		request, ok := limits.ReadBody(w, r)
+		if !ok {
+			return
+		}
+		noteQuery(r, string(request))
 		
-		mdReq, err := http.NewRequest("POST", mdServer, strings.NewReader(string(request)))
+		mdReq, err := http.NewRequest("POST", metadataURL(mdServer, auth.Authenticate(r)), strings.NewReader(string(request)))
 		mdReq.Header.Set("Content-Type", "text")
 		mdReq.Header.Set("Content-Length", fmt.Sprintf("%v", len(request)))
 		resp, err := http.DefaultClient.Do(mdReq)
@@ -776,12 +907,10 @@ func main() {
 			w.Write(buffer)
 		}
 		resp.Body.Close()
-	})
+	}))))
 	
 	var portStr string = fmt.Sprintf(":%v", port)
 	
-	certFile, ok1 := config["cert_file"]
-	keyFile, ok2 := config["key_file"]
 	if ok1 && ok2 {
 		log.Fatal(http.ListenAndServeTLS(portStr, certFile.(string), keyFile.(string), nil))
 	} else {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** A queryChunk is a piece of a large data request, which the query planner
+	splits off to run concurrently with the other pieces. */
+type queryChunk struct {
+	startTime int64
+	endTime int64
+}
+
+type chunkResult struct {
+	records []StatRecord
+	err error
+}
+
+/** Enables splitting of large data requests. A request spanning more than
+	CHUNKWINDOWS windows is split into chunks of at most that many windows,
+	and up to PARALLELISM chunks are queried at once. A CHUNKWINDOWS of zero
+	disables splitting. */
+func (rt *Router) EnableSplitting(chunkWindows int64, parallelism int) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	rt.chunkWindows = chunkWindows
+	rt.parallelism = parallelism
+}
+
+/** Divides the range [STARTTIME, ENDTIME) into chunks of at most
+	CHUNKWINDOWS windows of WIDTH nanoseconds each. Every chunk but the last
+	ends on a window boundary, so each chunk returns exactly the windows the
+	whole range would. Returns nil if the range fits in a single chunk. */
+func planChunks(startTime int64, endTime int64, width int64, chunkWindows int64) []queryChunk {
+	if chunkWindows <= 0 || width <= 0 || endTime <= startTime {
+		return nil
+	}
+	// Halve both ends separately so that the span can't overflow
+	var span uint64 = uint64((endTime >> 1) - (startTime >> 1)) << 1
+	if span / uint64(width) <= uint64(chunkWindows) {
+		return nil
+	}
+	
+	var chunkSpan uint64 = uint64(width) * uint64(chunkWindows)
+	if chunkSpan / uint64(chunkWindows) != uint64(width) {
+		return nil // a single chunk would cover every representable time
+	}
+	
+	var chunks []queryChunk = make([]queryChunk, 0, span / chunkSpan + 1)
+	var chunkStart int64 = startTime
+	for chunkStart < endTime {
+		var chunkEnd int64 = endTime
+		if uint64(endTime - chunkStart) > chunkSpan {
+			chunkEnd = chunkStart + int64(chunkSpan)
+		}
+		chunks = append(chunks, queryChunk{startTime: chunkStart, endTime: chunkEnd})
+		chunkStart = chunkEnd
+	}
+	return chunks
+}
+
+/** Returns true if the request should be split by the query planner. Calendar
+	rollups and pipelines are never split, since their windows and transforms
+	depend on data outside any one chunk. */
+func (rt *Router) shouldSplit(req *DataRequest) bool {
+	return rt.chunkWindows > 0 && req.Rollup == nil && len(req.Pipeline) == 0 &&
+		planChunks(req.StartTime, req.EndTime, req.WindowWidth(), rt.chunkWindows) != nil
+}
+
+/** Queries a large request in chunks, at most rt.parallelism at a time, and
+	writes the records to W as one array, in time order, as the chunks
+	complete. The array is preceded by PREFIX and followed by SUFFIX. If a
+	chunk fails, returns its error, and whether anything had been written by
+	then; if so, the response is left unterminated so that the client cannot
+	mistake the partial response for a complete one. */
+func (rt *Router) streamChunks(uuidBytes uuid.UUID, chunks []queryChunk, width int64, prefix string, suffix string, w io.Writer) (bool, error) {
+	var results []chan chunkResult = make([]chan chunkResult, len(chunks))
+	for i := range results {
+		results[i] = make(chan chunkResult, 1)
+	}
+	
+	// Bound the chunks in flight, including those finished but not yet
+	// written, so that a slow client doesn't make us buffer the whole range
+	var slots chan bool = make(chan bool, rt.parallelism)
+	var done chan bool = make(chan bool)
+	defer close(done)
+	
+	go func () {
+		for i, chunk := range chunks {
+			select {
+			case slots <- true:
+			case <-done:
+				return
+			}
+			go func (i int, chunk queryChunk) {
+				records, err := rt.QueryWidth(uuidBytes, chunk.startTime, chunk.endTime, width)
+				results[i] <- chunkResult{records: records, err: err}
+			}(i, chunk)
+		}
+	}()
+	
+	var started bool = false
+	var first bool = true
+	for i := range chunks {
+		var result chunkResult = <-results[i]
+		<-slots
+		if result.err != nil {
+			if started {
+				fmt.Printf("Chunk %v of %v for stream %v failed: %v\n", i + 1, len(chunks), uuidBytes.String(), result.err)
+			}
+			return started, result.err
+		}
+		if !started {
+			w.Write([]byte(prefix + "["))
+			started = true
+		}
+		for j := range result.records {
+			if !first {
+				w.Write([]byte(","))
+			}
+			formatStatRecord(&result.records[j], w)
+			first = false
+		}
+	}
+	w.Write([]byte("]" + suffix))
+	return true, nil
+}
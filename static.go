@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/** The frontend, bundled into the binary. */
+//go:embed index.html js
+var embeddedAssets embed.FS
+
+/** How long browsers may cache an asset requested by its content hash. */
+const IMMUTABLE_MAX_AGE string = "max-age=31536000, immutable"
+
+/** Matches the src and href attributes that refer to our own assets. */
+var assetReference *regexp.Regexp = regexp.MustCompile(`(src|href)="(js/[^"?#]+)"`)
+
+type staticAsset struct {
+	content []byte
+	hash string
+}
+
+/** A StaticAssets serves the frontend from memory. Every asset carries an ETag
+	derived from its content. The index page refers to the other assets by
+	URLs that include their content hash, so browsers may cache those forever;
+	the index page itself is revalidated on every load. */
+type StaticAssets struct {
+	assets map[string]*staticAsset
+	loaded time.Time
+}
+
+/** Loads the frontend from FILES, which is usually the embedded assets but
+	may be a directory on disk during development. */
+func LoadStaticAssets(files fs.FS) (*StaticAssets, error) {
+	var sa *StaticAssets = &StaticAssets{
+		assets: make(map[string]*staticAsset),
+		loaded: time.Now(),
+	}
+	err := fs.WalkDir(files, ".", func (name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		sa.assets["/" + name] = &staticAsset{content: content, hash: contentHash(content)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	
+	index, ok := sa.assets["/index.html"]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	index.content = assetReference.ReplaceAllFunc(index.content, func (match []byte) []byte {
+		var parts [][]byte = assetReference.FindSubmatch(match)
+		asset, ok := sa.assets["/" + string(parts[2])]
+		if !ok {
+			return match
+		}
+		return []byte(string(parts[1]) + "=\"" + string(parts[2]) + "?v=" + asset.hash + "\"")
+	})
+	index.hash = contentHash(index.content)
+	return sa, nil
+}
+
+func contentHash(content []byte) string {
+	var sum [sha256.Size]byte = sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (sa *StaticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Static files may only be read with GET or HEAD."))
+		return
+	}
+	
+	var name string = path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	asset, ok := sa.assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	
+	w.Header().Set("ETag", "\"" + asset.hash + "\"")
+	if r.URL.Query().Get("v") == asset.hash {
+		w.Header().Set("Cache-Control", "public, " + IMMUTABLE_MAX_AGE)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, sa.loaded, bytes.NewReader(asset.content))
+}
+
+/** Settings that the frontend reads from /config.json at startup. BACKEND is
+	the host, and port if necessary, to which the client should connect;
+	SECURE says whether to use wss:// and https://. */
+type ClientConfig struct {
+	Backend string `json:"backend,omitempty"`
+	Secure bool `json:"secure"`
+	DataConnections int `json:"data_connections"`
+	BracketConnections int `json:"bracket_connections"`
+	Features map[string]bool `json:"features"`
+}
+
+/** Serves the client configuration. If no backend is configured, the client
+	is told to connect to the host it requested the configuration from. */
+func (cc *ClientConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var response ClientConfig = *cc
+	if response.Backend == "" {
+		response.Backend = r.Host
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, &response)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	
+	quasar "github.com/SoftwareDefinedBuildings/webgl-plotter/quasar"
+)
+
+/** The number of recent errors kept for the status page. */
+const MAX_RECENT_ERRORS int = 50
+
+/** The number of streams listed as the most queried on the status page. */
+const TOP_STREAMS int = 20
+
+/** Once this many streams have been counted, the counts are halved and the
+	streams left with none are forgotten, so that the busiest recent streams
+	stand out. */
+const MAX_COUNTED_STREAMS int = 10000
+
+/** Recent errors, for the status page. */
+var recentErrors *ErrorLog = NewErrorLog(MAX_RECENT_ERRORS)
+
+type errorRecord struct {
+	Time time.Time `json:"time"`
+	Source string `json:"source"`
+	Error string `json:"error"`
+}
+
+/** An ErrorLog keeps the most recent errors. */
+type ErrorLog struct {
+	records []errorRecord
+	next int
+	lock *sync.Mutex
+}
+
+func NewErrorLog(capacity int) *ErrorLog {
+	return &ErrorLog{
+		records: make([]errorRecord, 0, capacity),
+		lock: &sync.Mutex{},
+	}
+}
+
+func (el *ErrorLog) Add(source string, err error) {
+	var record errorRecord = errorRecord{Time: time.Now().UTC(), Source: source, Error: err.Error()}
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	if len(el.records) < cap(el.records) {
+		el.records = append(el.records, record)
+	} else {
+		el.records[el.next] = record
+	}
+	el.next = (el.next + 1) % cap(el.records)
+}
+
+/** Returns the errors, most recent first. */
+func (el *ErrorLog) Recent() []errorRecord {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	var recent []errorRecord = make([]errorRecord, len(el.records))
+	for i := range recent {
+		recent[i] = el.records[(el.next - 1 - i + 2 * len(el.records)) % len(el.records)]
+	}
+	return recent
+}
+
+/** A StreamCounter counts the queries made for each stream. */
+type StreamCounter struct {
+	counts map[string]uint64
+	lock *sync.Mutex
+}
+
+func NewStreamCounter() *StreamCounter {
+	return &StreamCounter{
+		counts: make(map[string]uint64),
+		lock: &sync.Mutex{},
+	}
+}
+
+func (sc *StreamCounter) Count(uuidStr string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if _, ok := sc.counts[uuidStr]; !ok && len(sc.counts) >= MAX_COUNTED_STREAMS {
+		for key, count := range sc.counts {
+			if count /= 2; count == 0 {
+				delete(sc.counts, key)
+			} else {
+				sc.counts[key] = count
+			}
+		}
+	}
+	sc.counts[uuidStr]++
+}
+
+type streamCount struct {
+	Uuid string `json:"uuid"`
+	Queries uint64 `json:"queries"`
+}
+
+/** Returns the N most queried streams, most queried first. */
+func (sc *StreamCounter) Top(n int) []streamCount {
+	sc.lock.Lock()
+	var top []streamCount = make([]streamCount, 0, len(sc.counts))
+	for uuidStr, count := range sc.counts {
+		top = append(top, streamCount{Uuid: uuidStr, Queries: count})
+	}
+	sc.lock.Unlock()
+	
+	sort.Slice(top, func (i int, j int) bool {
+		return top[i].Queries > top[j].Queries || top[i].Queries == top[j].Queries && top[i].Uuid < top[j].Uuid
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+/** An open WebSocket, as shown on the status page. REQUESTS counts the
+	messages received; the rate is estimated from the messages received in
+	the current and previous minutes. */
+type socketInfo struct {
+	endpoint string
+	client string
+	user string
+	opened time.Time
+	requests uint64
+	minute int64
+	thisMinute uint64
+	lastMinute uint64
+	lock *sync.Mutex
+}
+
+/** Counts a message received on the socket. */
+func (si *socketInfo) Count() {
+	var minute int64 = time.Now().Unix() / 60
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	si.requests++
+	si.roll(minute)
+	si.thisMinute++
+}
+
+/** Moves the per-minute counts forward to MINUTE. The caller must hold the
+	lock. */
+func (si *socketInfo) roll(minute int64) {
+	if minute == si.minute + 1 {
+		si.lastMinute = si.thisMinute
+		si.thisMinute = 0
+	} else if minute > si.minute {
+		si.lastMinute = 0
+		si.thisMinute = 0
+	}
+	si.minute = minute
+}
+
+type socketStatus struct {
+	Endpoint string `json:"endpoint"`
+	Client string `json:"client"`
+	User string `json:"user,omitempty"`
+	Opened time.Time `json:"opened"`
+	Requests uint64 `json:"requests"`
+	PerMinute float64 `json:"per_minute"`
+}
+
+func (si *socketInfo) status(now time.Time) socketStatus {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	si.roll(now.Unix() / 60)
+	// Weight last minute by the part of it still within the past 60 seconds
+	var elapsed float64 = float64(now.Unix() % 60) / 60
+	return socketStatus{
+		Endpoint: si.endpoint,
+		Client: si.client,
+		User: si.user,
+		Opened: si.opened,
+		Requests: si.requests,
+		PerMinute: float64(si.thisMinute) + float64(si.lastMinute) * (1 - elapsed),
+	}
+}
+
+/** Tracks the open WebSockets. */
+type SocketRegistry struct {
+	sockets map[*socketInfo]bool
+	lock *sync.Mutex
+}
+
+func NewSocketRegistry() *SocketRegistry {
+	return &SocketRegistry{
+		sockets: make(map[*socketInfo]bool),
+		lock: &sync.Mutex{},
+	}
+}
+
+/** Registers a newly opened WebSocket. The caller must call Close when the
+	socket closes. */
+func (sr *SocketRegistry) Open(endpoint string, client string, user string) *socketInfo {
+	var si *socketInfo = &socketInfo{
+		endpoint: endpoint,
+		client: client,
+		user: user,
+		opened: time.Now().UTC(),
+		minute: time.Now().Unix() / 60,
+		lock: &sync.Mutex{},
+	}
+	sr.lock.Lock()
+	sr.sockets[si] = true
+	sr.lock.Unlock()
+	return si
+}
+
+func (sr *SocketRegistry) Close(si *socketInfo) {
+	sr.lock.Lock()
+	delete(sr.sockets, si)
+	sr.lock.Unlock()
+}
+
+func (sr *SocketRegistry) status() []socketStatus {
+	var now time.Time = time.Now()
+	sr.lock.Lock()
+	var statuses []socketStatus = make([]socketStatus, 0, len(sr.sockets))
+	for si := range sr.sockets {
+		statuses = append(statuses, si.status(now))
+	}
+	sr.lock.Unlock()
+	sort.Slice(statuses, func (i int, j int) bool {
+		return statuses[i].Opened.Before(statuses[j].Opened)
+	})
+	return statuses
+}
+
+/** The state of a backend. Data and Bracket are only set for QUASAR
+	backends. */
+type backendStatus struct {
+	Name string `json:"name"`
+	Busy bool `json:"busy"`
+	Data *quasar.Status `json:"data,omitempty"`
+	Bracket *quasar.Status `json:"bracket,omitempty"`
+}
+
+type budgetStatus struct {
+	Name string `json:"name"`
+	Active int `json:"active"`
+	Waiting int `json:"waiting"`
+}
+
+type cacheStatus struct {
+	Hits uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Records int `json:"records"`
+	Capacity int `json:"capacity"`
+}
+
+/** Everything shown on the status page. */
+type StatusReport struct {
+	Started time.Time `json:"started"`
+	Backends []backendStatus `json:"backends"`
+	Budgets []budgetStatus `json:"budgets"`
+	WebSockets []socketStatus `json:"websockets"`
+	TopStreams []streamCount `json:"top_streams"`
+	Cache cacheStatus `json:"cache"`
+	RecentErrors []errorRecord `json:"recent_errors"`
+}
+
+/** A Monitor reports on the state of the server. It serves /status.json, and
+	a page that shows the same report, on the admin listener. */
+type Monitor struct {
+	router *Router
+	budgets []*Budget
+	sockets *SocketRegistry
+	auth *Authenticator
+	started time.Time
+}
+
+func NewMonitor(router *Router, budgets []*Budget, sockets *SocketRegistry, auth *Authenticator) *Monitor {
+	return &Monitor{
+		router: router,
+		budgets: budgets,
+		sockets: sockets,
+		auth: auth,
+		started: time.Now().UTC(),
+	}
+}
+
+func (m *Monitor) Report() *StatusReport {
+	var report *StatusReport = &StatusReport{
+		Started: m.started,
+		Backends: make([]backendStatus, 0, len(m.router.pools)),
+		Budgets: make([]budgetStatus, len(m.budgets)),
+		WebSockets: m.sockets.status(),
+		TopStreams: m.router.usage.Top(TOP_STREAMS),
+		RecentErrors: recentErrors.Recent(),
+	}
+	for name, pool := range m.router.pools {
+		var bs backendStatus = backendStatus{Name: name, Busy: pool.backend.Busy()}
+		if qb, ok := pool.backend.(*QuasarBackend); ok {
+			data, bracket := qb.data.Status(), qb.bracket.Status()
+			bs.Data, bs.Bracket = &data, &bracket
+		}
+		report.Backends = append(report.Backends, bs)
+	}
+	sort.Slice(report.Backends, func (i int, j int) bool {
+		return report.Backends[i].Name < report.Backends[j].Name
+	})
+	for i, budget := range m.budgets {
+		active, waiting := budget.scheduler.Load()
+		report.Budgets[i] = budgetStatus{Name: budget.name, Active: active, Waiting: waiting}
+	}
+	
+	var rc *RecordCache = m.router.cache
+	if rc != nil {
+		report.Cache.Hits = atomic.LoadUint64(&rc.hits)
+		report.Cache.Misses = atomic.LoadUint64(&rc.misses)
+		if total := report.Cache.Hits + report.Cache.Misses; total != 0 {
+			report.Cache.HitRate = float64(report.Cache.Hits) / float64(total)
+		}
+		rc.lock.Lock()
+		report.Cache.Records = rc.size
+		report.Cache.Capacity = rc.capacity
+		rc.lock.Unlock()
+	}
+	return report
+}
+
+func (m *Monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(m.auth, w, r) {
+		return
+	}
+	switch r.URL.Path {
+	case "/status.json":
+		writeJSON(w, http.StatusOK, m.Report())
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := statusPage.Execute(w, m.Report())
+		if err != nil {
+			fmt.Printf("Could not render status page: %v\n", err)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var statusPage *template.Template = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+    <head>
+        <meta charset="utf-8">
+        <meta http-equiv="refresh" content="5">
+        <title>Plotter Status</title>
+        <style>
+            body { font-family: sans-serif; }
+            table { border-collapse: collapse; margin-bottom: 1em; }
+            th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+            .down { color: #c00; }
+        </style>
+    </head>
+    <body>
+        <h1>Plotter Status</h1>
+        <p>Up since {{.Started.Format "2006-01-02 15:04:05 MST"}}. <a href="status.json">JSON</a></p>
+        <h2>Backends</h2>
+        {{range .Backends}}
+        <h3>{{.Name}}</h3>
+        {{if .Data}}
+        <p>Data queries pending: {{.Data.Pending}} of {{.Data.MaxPending}}; bracket queries pending: {{.Bracket.Pending}} of {{.Bracket.MaxPending}}</p>
+        <table>
+            <tr><th>Kind</th><th>Replica</th><th>State</th><th>In flight</th></tr>
+            {{range .Data.Connections}}<tr><td>data</td><td>{{.Replica}}</td><td>{{if .Up}}up{{else}}<span class="down">down</span>{{end}}</td><td>{{.InFlight}}</td></tr>{{end}}
+            {{range .Bracket.Connections}}<tr><td>bracket</td><td>{{.Replica}}</td><td>{{if .Up}}up{{else}}<span class="down">down</span>{{end}}</td><td>{{.InFlight}}</td></tr>{{end}}
+        </table>
+        {{else}}
+        <p>{{if .Busy}}Busy{{else}}Idle{{end}}</p>
+        {{end}}
+        {{end}}
+        <h2>Scheduling</h2>
+        <table>
+            <tr><th>Budget</th><th>Active</th><th>Waiting</th></tr>
+            {{range .Budgets}}<tr><td>{{.Name}}</td><td>{{.Active}}</td><td>{{.Waiting}}</td></tr>{{end}}
+        </table>
+        <h2>Cache</h2>
+        <p>{{.Cache.Hits}} hits, {{.Cache.Misses}} misses (hit rate {{printf "%.3f" .Cache.HitRate}}); {{.Cache.Records}} of {{.Cache.Capacity}} records used</p>
+        <h2>WebSockets</h2>
+        <table>
+            <tr><th>Endpoint</th><th>Client</th><th>User</th><th>Opened</th><th>Requests</th><th>Per minute</th></tr>
+            {{range .WebSockets}}<tr><td>{{.Endpoint}}</td><td>{{.Client}}</td><td>{{.User}}</td><td>{{.Opened.Format "15:04:05"}}</td><td>{{.Requests}}</td><td>{{printf "%.0f" .PerMinute}}</td></tr>{{end}}
+        </table>
+        <h2>Most Queried Streams</h2>
+        <table>
+            <tr><th>UUID</th><th>Queries</th></tr>
+            {{range .TopStreams}}<tr><td>{{.Uuid}}</td><td>{{.Queries}}</td></tr>{{end}}
+        </table>
+        <h2>Recent Errors</h2>
+        <table>
+            <tr><th>Time</th><th>Source</th><th>Error</th></tr>
+            {{range .RecentErrors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Source}}</td><td>{{.Error}}</td></tr>{{end}}
+        </table>
+    </body>
+</html>
+`))
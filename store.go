@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var validKey *regexp.Regexp = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+/** A DiskStore keeps JSON documents in a directory on disk, one file per
+	key. Writes go to a temporary file that is then renamed into place, so a
+	crash never leaves a document half-written. */
+type DiskStore struct {
+	dir string
+	lock *sync.RWMutex
+}
+
+/** Creates a DiskStore backed by the specified directory, creating the
+	directory if necessary. */
+func NewDiskStore(dir string) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskStore{
+		dir: dir,
+		lock: &sync.RWMutex{},
+	}, nil
+}
+
+/** Returns true if a document can be stored under KEY. Lookups of other keys
+	are mistakes by the client, not failures of the store. */
+func isValidKey(key string) bool {
+	return validKey.MatchString(key) && !strings.HasPrefix(key, ".")
+}
+
+func (ds *DiskStore) path(key string) (string, error) {
+	if !isValidKey(key) {
+		return "", fmt.Errorf("Invalid key %v", key)
+	}
+	return filepath.Join(ds.dir, key + ".json"), nil
+}
+
+/** Reads the document stored under KEY into V. Returns false if there is no
+	such document. */
+func (ds *DiskStore) Get(key string, v interface{}) (bool, error) {
+	path, err := ds.path(key)
+	if err != nil {
+		return false, err
+	}
+	
+	ds.lock.RLock()
+	contents, err := ioutil.ReadFile(path)
+	ds.lock.RUnlock()
+	
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	
+	err = json.Unmarshal(contents, v)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/** Stores V under KEY, replacing any existing document. */
+func (ds *DiskStore) Put(key string, v interface{}) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return ds.write(key, v)
+}
+
+/** Stores V under KEY unless a document is already stored there. Returns
+	false if the key was taken. */
+func (ds *DiskStore) PutNew(key string, v interface{}) (bool, error) {
+	path, err := ds.path(key)
+	if err != nil {
+		return false, err
+	}
+	
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	
+	_, err = os.Stat(path)
+	if err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	
+	return true, ds.write(key, v)
+}
+
+func (ds *DiskStore) write(key string, v interface{}) error {
+	path, err := ds.path(key)
+	if err != nil {
+		return err
+	}
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	
+	tmp, err := ioutil.TempFile(ds.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(contents)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/** Removes the document stored under KEY, if there is one. */
+func (ds *DiskStore) Delete(key string) error {
+	path, err := ds.path(key)
+	if err != nil {
+		return err
+	}
+	
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+/** Returns the keys of all stored documents. */
+func (ds *DiskStore) Keys() ([]string, error) {
+	ds.lock.RLock()
+	entries, err := ioutil.ReadDir(ds.dir)
+	ds.lock.RUnlock()
+	
+	if err != nil {
+		return nil, err
+	}
+	
+	var keys []string = make([]string, 0, len(entries))
+	for _, entry := range entries {
+		var name string = entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(name, ".json"))
+	}
+	return keys, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	
+	uuid "code.google.com/p/go-uuid/uuid"
+)
+
+/** A Transform turns the statistical records of a stream into those of a new
+	stream. Parameters are given as durations, and converted to a number of
+	windows according to the window width, so that a transform looks the same
+	at every zoom level. */
+type Transform interface {
+	/* Returns how long before the start of the requested range the input must
+	   begin for the output to be correct over the whole range. */
+	Lookback(width int64) int64
+	/* Transforms RECORDS, in windows of WIDTH nanoseconds. The requested range
+	   begins at START; the records before it are only there to settle. */
+	Apply(records []StatRecord, width int64, start int64) []StatRecord
+	String() string
+}
+
+/** A Pipeline is a chain of transforms, applied in order. */
+type Pipeline []Transform
+
+/** Parses a pipeline of the form "mean(10m)|lowpass(1h)|derivative". */
+func ParsePipeline(spec string) (Pipeline, error) {
+	var pipeline Pipeline = make(Pipeline, 0)
+	if strings.TrimSpace(spec) == "" {
+		return pipeline, nil
+	}
+	for _, stage := range strings.Split(spec, "|") {
+		stage = strings.TrimSpace(stage)
+		var name string = stage
+		var arg string = ""
+		if paren := strings.IndexByte(stage, '('); paren != -1 {
+			if !strings.HasSuffix(stage, ")") {
+				return nil, fmt.Errorf("Missing ')' in transform %v", stage)
+			}
+			name = stage[:paren]
+			arg = strings.TrimSpace(stage[paren + 1:len(stage) - 1])
+		}
+		
+		var t Transform
+		switch name {
+		case "mean", "lowpass", "highpass":
+			d, err := time.ParseDuration(arg)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("Transform %v requires a positive duration; got %q", name, arg)
+			}
+			switch name {
+			case "mean":
+				t = rollingMean{width: d.Nanoseconds()}
+			case "lowpass":
+				t = expFilter{tau: d.Nanoseconds(), high: false}
+			case "highpass":
+				t = expFilter{tau: d.Nanoseconds(), high: true}
+			}
+		case "derivative", "integral":
+			if arg != "" {
+				return nil, fmt.Errorf("Transform %v takes no arguments", name)
+			}
+			if name == "derivative" {
+				t = derivative{}
+			} else {
+				t = integral{}
+			}
+		default:
+			return nil, fmt.Errorf("Unknown transform %v", name)
+		}
+		pipeline = append(pipeline, t)
+	}
+	return pipeline, nil
+}
+
+func (p Pipeline) String() string {
+	var stages []string = make([]string, len(p))
+	for i, t := range p {
+		stages[i] = t.String()
+	}
+	return strings.Join(stages, "|")
+}
+
+/** Returns how far before the requested range the pipeline needs its input
+	to begin, rounded up to a whole window. */
+func (p Pipeline) Lookback(width int64) int64 {
+	if width <= 0 || len(p) == 0 {
+		return 0
+	}
+	var total int64 = 0
+	for _, t := range p {
+		total += t.Lookback(width)
+	}
+	return ((total + width - 1) / width) * width
+}
+
+/** Returns where the input of the pipeline must begin for output in windows
+	of WIDTH nanoseconds starting at STARTTIME: the lookback before it, but no
+	earlier than the first window on the same grid that QUASAR can hold. */
+func (p Pipeline) QueryStart(startTime int64, width int64) int64 {
+	var lookback int64 = p.Lookback(width)
+	if width <= 0 || startTime < QUASAR_LOW {
+		return startTime
+	}
+	var earliest int64 = startTime - (startTime - QUASAR_LOW) / width * width
+	if lookback < 0 || startTime - earliest < lookback {
+		return earliest
+	}
+	return startTime - lookback
+}
+
+func (p Pipeline) Apply(records []StatRecord, width int64, start int64) []StatRecord {
+	for _, t := range p {
+		records = t.Apply(records, width, start)
+	}
+	return records
+}
+
+/** Replaces each window with the count-weighted mean of the windows in the
+	preceding WIDTH nanoseconds, itself included. */
+type rollingMean struct {
+	width int64
+}
+
+func (t rollingMean) Lookback(width int64) int64 {
+	return t.width
+}
+
+func (t rollingMean) Apply(records []StatRecord, width int64, start int64) []StatRecord {
+	var result []StatRecord = make([]StatRecord, len(records))
+	var first int = 0
+	var sum float64 = 0
+	var count uint64 = 0
+	for i := range records {
+		sum += records[i].Mean * float64(records[i].Count)
+		count += records[i].Count
+		for records[first].Time <= records[i].Time - t.width + width - 1 && first < i {
+			sum -= records[first].Mean * float64(records[first].Count)
+			count -= records[first].Count
+			first++
+		}
+		
+		result[i] = StatRecord{
+			Time: records[i].Time,
+			Min: records[first].Min,
+			Max: records[first].Max,
+			Count: count,
+		}
+		for j := first + 1; j <= i; j++ {
+			result[i].Min = math.Min(result[i].Min, records[j].Min)
+			result[i].Max = math.Max(result[i].Max, records[j].Max)
+		}
+		if count != 0 {
+			result[i].Mean = sum / float64(count)
+		} else {
+			result[i].Mean = records[i].Mean
+		}
+	}
+	return result
+}
+
+func (t rollingMean) String() string {
+	return fmt.Sprintf("mean(%v)", time.Duration(t.width))
+}
+
+/** The rate of change of the mean, per second, between consecutive windows. */
+type derivative struct {}
+
+func (t derivative) Lookback(width int64) int64 {
+	return width
+}
+
+func (t derivative) Apply(records []StatRecord, width int64, start int64) []StatRecord {
+	var result []StatRecord = make([]StatRecord, 0, len(records))
+	for i := 1; i < len(records); i++ {
+		var seconds float64 = float64(records[i].Time - records[i - 1].Time) / 1e9
+		var rate float64 = (records[i].Mean - records[i - 1].Mean) / seconds
+		var count uint64 = records[i].Count
+		if records[i - 1].Count < count {
+			count = records[i - 1].Count
+		}
+		result = append(result, StatRecord{Time: records[i].Time, Min: rate, Mean: rate, Max: rate, Count: count})
+	}
+	return result
+}
+
+func (t derivative) String() string {
+	return "derivative"
+}
+
+/** The integral of the stream over time, in units of the stream times
+	seconds, starting from zero at the beginning of the requested range, and
+	zero before it. Missing windows contribute nothing. The minimum and maximum of each window
+	are the values of the integral at its two ends. */
+type integral struct {}
+
+func (t integral) Lookback(width int64) int64 {
+	return 0
+}
+
+func (t integral) Apply(records []StatRecord, width int64, start int64) []StatRecord {
+	var result []StatRecord = make([]StatRecord, len(records))
+	var seconds float64 = float64(width) / 1e9
+	var total float64 = 0
+	for i := range records {
+		var before float64 = total
+		if records[i].Time >= start {
+			total += records[i].Mean * seconds
+		}
+		result[i] = StatRecord{
+			Time: records[i].Time,
+			Min: math.Min(before, total),
+			Mean: total,
+			Max: math.Max(before, total),
+			Count: records[i].Count,
+		}
+	}
+	return result
+}
+
+func (t integral) String() string {
+	return "integral"
+}
+
+/** A first-order exponential low-pass filter with time constant TAU, or the
+	corresponding high-pass filter, which is the input minus its low-pass. The
+	filter is applied to the minimum, mean and maximum separately, which keeps
+	them in order. */
+type expFilter struct {
+	tau int64
+	high bool
+}
+
+func (t expFilter) Lookback(width int64) int64 {
+	// After five time constants, the initial state has decayed to under 1%
+	return 5 * t.tau
+}
+
+func (t expFilter) Apply(records []StatRecord, width int64, start int64) []StatRecord {
+	var result []StatRecord = make([]StatRecord, len(records))
+	if len(records) == 0 {
+		return result
+	}
+	var lo float64 = records[0].Min
+	var mean float64 = records[0].Mean
+	var hi float64 = records[0].Max
+	for i := range records {
+		if i > 0 {
+			var alpha float64 = 1 - math.Exp(-float64(records[i].Time - records[i - 1].Time) / float64(t.tau))
+			lo += alpha * (records[i].Min - lo)
+			mean += alpha * (records[i].Mean - mean)
+			hi += alpha * (records[i].Max - hi)
+		}
+		result[i] = records[i]
+		if t.high {
+			result[i].Min = records[i].Min - mean
+			result[i].Mean = records[i].Mean - mean
+			result[i].Max = records[i].Max - mean
+		} else {
+			result[i].Min = lo
+			result[i].Mean = mean
+			result[i].Max = hi
+		}
+	}
+	return result
+}
+
+func (t expFilter) String() string {
+	if t.high {
+		return fmt.Sprintf("highpass(%v)", time.Duration(t.tau))
+	}
+	return fmt.Sprintf("lowpass(%v)", time.Duration(t.tau))
+}
+
+/** Obtains statistical records in windows of WIDTH nanoseconds for a stream
+	and passes them through a pipeline. The input is fetched starting early
+	enough for the transforms to settle, and the output is trimmed to the
+	requested range. Results are cached, keyed by the stream, range, window
+	width and pipeline, unless the range ends too recently for its data to
+	have settled. */
+func (rt *Router) QueryPipeline(uuidBytes uuid.UUID, startTime int64, endTime int64, width int64, pipeline Pipeline) ([]StatRecord, error) {
+	if len(pipeline) == 0 {
+		return rt.QueryWidth(uuidBytes, startTime, endTime, width)
+	}
+	
+	var key string = fmt.Sprintf("%v,%v,%v,%v,%v", uuidBytes.String(), startTime, endTime, width, pipeline.String())
+	var cacheable bool = endTime <= settledTime()
+	if cacheable {
+		if records, ok := rt.cache.Get(key); ok {
+			return records, nil
+		}
+	}
+	
+	records, err := rt.QueryWidth(uuidBytes, pipeline.QueryStart(startTime, width), endTime, width)
+	if err != nil {
+		return nil, err
+	}
+	
+	records = pipeline.Apply(records, width, startTime)
+	var first int = 0
+	for first < len(records) && records[first].Time < startTime {
+		first++
+	}
+	records = records[first:]
+	
+	if cacheable {
+		rt.cache.Put(key, records)
+	}
+	return records, nil
+}
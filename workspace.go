@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** The largest workspace, in bytes, that we accept. */
+const MAX_WORKSPACE_SIZE int64 = 4 << 20
+
+const WORKSPACE_ID_LENGTH int = 12
+
+/** A Workspace is a named layout of several plots that belongs to one user.
+	Users holding any of SHAREDTAGS may view it, but only the owner may change
+	or delete it. */
+type Workspace struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	Owner string `json:"owner"`
+	Plots []*PlotState `json:"plots"`
+	SharedTags []string `json:"shared_tags,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+/** What we return when listing workspaces; the plots are left out. */
+type workspaceSummary struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	Owner string `json:"owner"`
+	NumPlots int `json:"num_plots"`
+	Updated time.Time `json:"updated"`
+}
+
+/** The fields of a workspace that clients may set. */
+type workspaceRequest struct {
+	Name string `json:"name"`
+	Plots []*PlotState `json:"plots"`
+	SharedTags []string `json:"shared_tags"`
+}
+
+func (req *workspaceRequest) validate() error {
+	if strings.TrimSpace(req.Name) == "" {
+		return fmt.Errorf("A workspace must have a name")
+	}
+	for i, plot := range req.Plots {
+		if plot == nil {
+			return fmt.Errorf("Plot %v is empty", i)
+		}
+		err := plot.Validate()
+		if err != nil {
+			return fmt.Errorf("Plot %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+/** A WorkspaceService stores workspaces on behalf of authenticated users.
+	GET /workspaces lists the workspaces a user can see, POST /workspaces
+	creates one, and GET, PUT and DELETE on /workspaces/ID read, replace and
+	remove a single workspace. */
+type WorkspaceService struct {
+	store *DiskStore
+	auth *Authenticator
+	lock *sync.Mutex // serializes changes, so that names stay unique per owner
+}
+
+func NewWorkspaceService(store *DiskStore, auth *Authenticator) *WorkspaceService {
+	return &WorkspaceService{
+		store: store,
+		auth: auth,
+		lock: &sync.Mutex{},
+	}
+}
+
+/** Returns true if the principal may view the workspace. */
+func canView(p *Principal, ws *Workspace) bool {
+	return ws.Owner == p.User || p.HasAnyTag(ws.SharedTags)
+}
+
+/** Returns every workspace the principal can view, ordered by name. */
+func (wss *WorkspaceService) List(p *Principal) ([]*Workspace, error) {
+	keys, err := wss.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Workspace = make([]*Workspace, 0)
+	for _, key := range keys {
+		var ws Workspace
+		found, err := wss.store.Get(key, &ws)
+		if err != nil {
+			fmt.Printf("Could not read workspace %v: %v\n", key, err)
+			continue
+		}
+		if found && canView(p, &ws) {
+			result = append(result, &ws)
+		}
+	}
+	sort.Slice(result, func (i int, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+/** Returns the workspace with the specified ID, or nil if it does not exist. */
+func (wss *WorkspaceService) Get(id string) (*Workspace, error) {
+	var ws Workspace
+	found, err := wss.store.Get(id, &ws)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+/** Returns an error if the owner already has a workspace other than EXCEPTID
+	with the specified name. The caller must hold the lock. */
+func (wss *WorkspaceService) checkNameFree(owner string, name string, exceptID string) error {
+	keys, err := wss.store.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key == exceptID {
+			continue
+		}
+		var ws Workspace
+		found, err := wss.store.Get(key, &ws)
+		if err == nil && found && ws.Owner == owner && ws.Name == name {
+			return errNameTaken
+		}
+	}
+	return nil
+}
+
+var errNameTaken error = fmt.Errorf("You already have a workspace with that name")
+
+/** Creates a new workspace owned by the principal. */
+func (wss *WorkspaceService) Create(p *Principal, req *workspaceRequest) (*Workspace, error) {
+	wss.lock.Lock()
+	defer wss.lock.Unlock()
+	
+	err := wss.checkNameFree(p.User, req.Name, "")
+	if err != nil {
+		return nil, err
+	}
+	
+	var now time.Time = time.Now().UTC()
+	var ws *Workspace = &Workspace{
+		Name: req.Name,
+		Owner: p.User,
+		Plots: req.Plots,
+		SharedTags: req.SharedTags,
+		Created: now,
+		Updated: now,
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		ws.ID, err = randomID(WORKSPACE_ID_LENGTH)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := wss.store.PutNew(ws.ID, ws)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			return ws, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find an unused workspace ID")
+}
+
+/** Replaces the contents of an existing workspace. Returns nil if the
+	workspace does not exist. */
+func (wss *WorkspaceService) Update(id string, req *workspaceRequest) (*Workspace, error) {
+	wss.lock.Lock()
+	defer wss.lock.Unlock()
+	
+	ws, err := wss.Get(id)
+	if err != nil || ws == nil {
+		return nil, err
+	}
+	
+	err = wss.checkNameFree(ws.Owner, req.Name, id)
+	if err != nil {
+		return nil, err
+	}
+	
+	ws.Name = req.Name
+	ws.Plots = req.Plots
+	ws.SharedTags = req.SharedTags
+	ws.Updated = time.Now().UTC()
+	
+	err = wss.store.Put(id, ws)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+func (wss *WorkspaceService) Delete(id string) error {
+	wss.lock.Lock()
+	defer wss.lock.Unlock()
+	return wss.store.Delete(id)
+}
+
+func (wss *WorkspaceService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var p *Principal = wss.auth.Authenticate(r)
+	if p == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You must be logged in to use workspaces."))
+		return
+	}
+	
+	var id string = strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/workspaces"), "/")
+	
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			workspaces, err := wss.List(p)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(fmt.Sprintf("Could not list workspaces: %v", err)))
+				return
+			}
+			var summaries []workspaceSummary = make([]workspaceSummary, len(workspaces))
+			for i, ws := range workspaces {
+				summaries[i] = workspaceSummary{
+					ID: ws.ID,
+					Name: ws.Name,
+					Owner: ws.Owner,
+					NumPlots: len(ws.Plots),
+					Updated: ws.Updated,
+				}
+			}
+			writeJSON(w, http.StatusOK, summaries)
+		case "POST":
+			req, ok := readWorkspaceRequest(w, r)
+			if !ok {
+				return
+			}
+			ws, err := wss.Create(p, req)
+			if !writeWorkspaceError(w, err) {
+				writeJSON(w, http.StatusCreated, ws)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("You must GET or POST /workspaces."))
+		}
+		return
+	}
+	
+	if r.Method != "GET" && r.Method != "PUT" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("You must GET, PUT or DELETE /workspaces/ID."))
+		return
+	}
+	
+	if !isValidKey(id) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("No workspace with ID %v", id)))
+		return
+	}
+	
+	ws, err := wss.Get(id)
+	if writeWorkspaceError(w, err) {
+		return
+	}
+	if ws == nil || !canView(p, ws) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("No workspace with ID %v", id)))
+		return
+	}
+	
+	if r.Method == "GET" {
+		writeJSON(w, http.StatusOK, ws)
+		return
+	}
+	
+	if ws.Owner != p.User {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Only the owner of a workspace may change it."))
+		return
+	}
+	
+	if r.Method == "DELETE" {
+		err = wss.Delete(id)
+		if !writeWorkspaceError(w, err) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	
+	req, ok := readWorkspaceRequest(w, r)
+	if !ok {
+		return
+	}
+	ws, err = wss.Update(id, req)
+	if writeWorkspaceError(w, err) {
+		return
+	}
+	if ws == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("No workspace with ID %v", id)))
+		return
+	}
+	writeJSON(w, http.StatusOK, ws)
+}
+
+/** Reads and validates the body of a POST or PUT request. If it is invalid,
+	an error response is written and OK is false. */
+func readWorkspaceRequest(w http.ResponseWriter, r *http.Request) (req *workspaceRequest, ok bool) {
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_WORKSPACE_SIZE + 1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Could not read received payload: %v", err)))
+		return
+	}
+	if int64(len(payload)) > MAX_WORKSPACE_SIZE {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("Workspace may be at most %v bytes", MAX_WORKSPACE_SIZE)))
+		return
+	}
+	
+	req = &workspaceRequest{}
+	err = json.Unmarshal(payload, req)
+	if err == nil {
+		err = req.validate()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid workspace: %v", err)))
+		return
+	}
+	
+	ok = true
+	return
+}
+
+/** Writes an error response if ERR is not nil, and returns whether it did. */
+func writeWorkspaceError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errNameTaken {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+	return true
+}